@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/types"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	adminShutdownTimeout = time.Second * 5
+	cachePath            = "/cache"
+	cacheRefreshPath     = "/cache/refresh"
+	breakerPath          = "/breaker"
+	limiterPath          = "/limiter"
+)
+
+// cacheEntry is the admin representation of a cached alarm
+type cacheEntry struct {
+	MoRef string           `json:"moref"`
+	Name  string           `json:"name"`
+	Age   int64            `json:"age"` // seconds since the alarm was added
+	Info  *types.AlarmInfo `json:"info,omitempty"`
+}
+
+// refreshResult is the admin representation of a cache refresh
+type refreshResult struct {
+	Refreshed []string          `json:"refreshed"`
+	Failed    map[string]string `json:"failed,omitempty"`
+}
+
+// runAdmin starts the admin HTTP server and blocks until the context is
+// cancelled. A zero admin port disables the admin server. The endpoints are not
+// authenticated and the server listens on the loopback interface by default.
+func (a *alarmServer) runAdmin(ctx context.Context) error {
+	if a.adminPort == 0 {
+		return nil
+	}
+
+	if err := serveHTTP(ctx, a.adminHost, a.adminPort, a.adminHandler(ctx)); err != nil {
+		return fmt.Errorf("run admin server: %w", err)
+	}
+	return nil
+}
+
+// serveHTTP serves the handler on the specified host and port until the
+// context is cancelled, an empty host listens on all interfaces
+func serveHTTP(ctx context.Context, host string, port int, handler http.Handler) error {
+	srv := &http.Server{
+		Addr:    net.JoinHostPort(host, strconv.Itoa(port)),
+		Handler: handler,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logging.FromContext(ctx).Warnf("shutdown http server on port %d: %v", port, err)
+		}
+		if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
+}
+
+// adminHandler returns the HTTP handler serving the admin endpoints. The
+// context is used for logging and vCenter calls triggered by the handlers.
+func (a *alarmServer) adminHandler(ctx context.Context) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(cachePath, a.handleCache)
+	mux.HandleFunc(cachePath+"/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == cacheRefreshPath {
+			a.handleCacheRefresh(ctx, w, r)
+			return
+		}
+		a.handleCacheEntry(w, r)
+	})
+	mux.HandleFunc(breakerPath, a.handleBreaker)
+	mux.HandleFunc(limiterPath, a.handleLimiter)
+	mux.HandleFunc(recentPath, a.handleRecent)
+	mux.HandleFunc(alarmsPath, a.handleAlarms)
+	mux.HandleFunc(logLevelPath, a.handleLogLevel)
+	return mux
+}
+
+// handleLimiter returns the concurrency limits and queue depth of the receiver
+func (a *alarmServer) handleLimiter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.limiter.status())
+}
+
+// handleBreaker returns the state of the vCenter circuit breaker
+func (a *alarmServer) handleBreaker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.breaker.status())
+}
+
+// handleCache lists (GET) or flushes (DELETE) all cached alarms
+func (a *alarmServer) handleCache(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		entries := []cacheEntry{}
+		for _, k := range a.cache.keys() {
+			if e, ok := a.cacheEntry(k, false); ok {
+				entries = append(entries, e)
+			}
+		}
+		writeJSON(w, http.StatusOK, entries)
+	case http.MethodDelete:
+		n := a.cache.flush()
+		writeJSON(w, http.StatusOK, map[string]int{"evicted": n})
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// handleCacheEntry returns (GET) or evicts (DELETE) a single cached alarm
+func (a *alarmServer) handleCacheEntry(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, cachePath+"/")
+	if key == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		e, ok := a.cacheEntry(key, true)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Errorf("alarm %q not found in cache", key))
+			return
+		}
+		writeJSON(w, http.StatusOK, e)
+	case http.MethodDelete:
+		if !a.cache.remove(key) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("alarm %q not found in cache", key))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"evicted": 1})
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// handleCacheRefresh retrieves all cached alarms from vCenter and replaces the
+// cached items. Alarms which cannot be retrieved are evicted unless vCenter is
+// unavailable.
+func (a *alarmServer) handleCacheRefresh(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	logger := logging.FromContext(ctx)
+	res := refreshResult{
+		Refreshed: []string{},
+		Failed:    map[string]string{},
+	}
+
+	for _, k := range a.cache.keys() {
+		var moref types.ManagedObjectReference
+		if !moref.FromString(k) {
+			a.cache.remove(k)
+			res.Failed[k] = "invalid managed object reference"
+			continue
+		}
+
+		alarm, err := a.retrieveAlarm(r.Context(), moref)
+		if err != nil {
+			logger.Warnw("refresh cached alarm", "moref", k, "error", err)
+			if !errors.Is(err, errBreakerOpen) && !vcenterUnavailable(err) {
+				a.cache.remove(k)
+			}
+			res.Failed[k] = err.Error()
+			continue
+		}
+
+		a.cache.add(k, alarm)
+		res.Refreshed = append(res.Refreshed, k)
+	}
+
+	logger.Infow("refreshed alarm cache", "refreshed", len(res.Refreshed), "failed", len(res.Failed))
+	writeJSON(w, http.StatusOK, res)
+}
+
+// cacheEntry returns the admin representation of the cached alarm with the
+// specified key, optionally including the full alarm info
+func (a *alarmServer) cacheEntry(key string, withInfo bool) (cacheEntry, bool) {
+	alarm, found := a.cache.get(key)
+	if !found {
+		return cacheEntry{}, false
+	}
+
+	age, found := a.cache.age(key)
+	if !found {
+		return cacheEntry{}, false
+	}
+
+	e := cacheEntry{
+		MoRef: key,
+		Name:  alarm.Info.Name,
+		Age:   age,
+	}
+	if withInfo {
+		info := alarm.Info
+		e.Info = &info
+	}
+	return e, true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+}
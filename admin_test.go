@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func Test_alarmServer_adminHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		wantCode int
+		wantBody string
+		wantKeys []string // remaining cache keys
+	}{
+		{
+			name:     "list cached alarms",
+			method:   http.MethodGet,
+			path:     "/cache",
+			wantCode: http.StatusOK,
+			wantBody: `[{"moref":"Alarm:alarm-1","name":"alarm-1","age":30},{"moref":"Alarm:alarm-2","name":"alarm-2","age":30}]`,
+			wantKeys: []string{"Alarm:alarm-1", "Alarm:alarm-2"},
+		},
+		{
+			name:     "get cached alarm",
+			method:   http.MethodGet,
+			path:     "/cache/Alarm:alarm-1",
+			wantCode: http.StatusOK,
+			wantKeys: []string{"Alarm:alarm-1", "Alarm:alarm-2"},
+		},
+		{
+			name:     "get unknown alarm",
+			method:   http.MethodGet,
+			path:     "/cache/Alarm:alarm-3",
+			wantCode: http.StatusNotFound,
+			wantBody: `{"error":"alarm \"Alarm:alarm-3\" not found in cache"}`,
+			wantKeys: []string{"Alarm:alarm-1", "Alarm:alarm-2"},
+		},
+		{
+			name:     "evict cached alarm",
+			method:   http.MethodDelete,
+			path:     "/cache/Alarm:alarm-1",
+			wantCode: http.StatusOK,
+			wantBody: `{"evicted":1}`,
+			wantKeys: []string{"Alarm:alarm-2"},
+		},
+		{
+			name:     "evict unknown alarm",
+			method:   http.MethodDelete,
+			path:     "/cache/Alarm:alarm-3",
+			wantCode: http.StatusNotFound,
+			wantKeys: []string{"Alarm:alarm-1", "Alarm:alarm-2"},
+		},
+		{
+			name:     "flush cache",
+			method:   http.MethodDelete,
+			path:     "/cache",
+			wantCode: http.StatusOK,
+			wantBody: `{"evicted":2}`,
+			wantKeys: []string{},
+		},
+		{
+			name:     "invalid method",
+			method:   http.MethodPut,
+			path:     "/cache",
+			wantCode: http.StatusMethodNotAllowed,
+			wantKeys: []string{"Alarm:alarm-1", "Alarm:alarm-2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newAlarmCache(3600)
+			mock := clock.NewMock()
+			c.clock = mock
+			c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+			c.add("Alarm:alarm-2", createAlarm(t, "alarm-2"))
+			mock.Add(time.Second * 30)
+
+			a := &alarmServer{cache: c}
+			ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			a.adminHandler(ctx).ServeHTTP(rec, req)
+
+			assert.Equal(t, rec.Code, tt.wantCode)
+			if tt.wantBody != "" {
+				assert.Equal(t, strings.TrimSpace(rec.Body.String()), tt.wantBody)
+			}
+			assert.DeepEqual(t, c.keys(), tt.wantKeys)
+		})
+	}
+}
+
+func Test_alarmServer_handleCacheRefresh(t *testing.T) {
+	simulator.Test(func(ctx context.Context, client *vim25.Client) {
+		vc := simulatorClient(t, client, "alarm-1")
+
+		c := newAlarmCache(3600)
+		stale := createAlarm(t, "alarm-1")
+		stale.Info.Description = "stale"
+		c.add("Alarm:alarm-1", stale)
+		c.add("Alarm:alarm-2", createAlarm(t, "alarm-2")) // unknown to vcenter
+
+		a := &alarmServer{
+			session: newSession(vc, ""),
+			cache:   c,
+		}
+		ctx = logging.WithLogger(ctx, zaptest.NewLogger(t).Sugar())
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/cache/refresh", nil)
+		a.adminHandler(ctx).ServeHTTP(rec, req)
+		assert.Equal(t, rec.Code, http.StatusOK)
+
+		var res refreshResult
+		err := json.NewDecoder(rec.Body).Decode(&res)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, res.Refreshed, []string{"Alarm:alarm-1"})
+		assert.Equal(t, len(res.Failed), 1)
+
+		got, found := c.get("Alarm:alarm-1")
+		assert.Assert(t, found)
+		assert.Equal(t, got.Info.Description, "A test alarm")
+
+		_, found = c.get("Alarm:alarm-2")
+		assert.Assert(t, !found)
+	})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// decision records how an event was handled
+type decision struct {
+	start    time.Time
+	moref    string
+	alarm    string // name of the alarm
+	cacheHit bool
+	outcome  string
+	reason   string
+	path     []string           // steps taken to handle the event
+	output   *cloudevents.Event // returned event, if any
+
+	dedupKeys []string // remembered deduplication keys, released if the event is rejected
+}
+
+// step adds a step to the decision path
+func (d *decision) step(format string, args ...interface{}) {
+	if d == nil {
+		return
+	}
+	d.path = append(d.path, fmt.Sprintf(format, args...))
+}
+
+type decisionKey struct{}
+
+func withDecision(ctx context.Context, d *decision) context.Context {
+	return context.WithValue(ctx, decisionKey{}, d)
+}
+
+// decisionFrom returns the decision of the event handled with the context or
+// nil
+func decisionFrom(ctx context.Context) *decision {
+	d, _ := ctx.Value(decisionKey{}).(*decision)
+	return d
+}
+
+// outcome records the outcome of the event in the decision of the context and
+// the metrics
+func (a *alarmServer) outcome(ctx context.Context, event cloudevents.Event, outcome, reason string) {
+	if d := decisionFrom(ctx); d != nil {
+		d.outcome = outcome
+		d.reason = reason
+	}
+	a.metrics.event(outcome, reason)
+}
+
+// record writes the decision for the event to the audit log and the recent
+// events
+func (a *alarmServer) record(event cloudevents.Event, d *decision) {
+	a.audit(event, d)
+	a.recent.add(event, d, a.now())
+}
+
+// audit writes the decision for the event to the audit log
+func (a *alarmServer) audit(event cloudevents.Event, d *decision) {
+	if a.auditLog == nil {
+		return
+	}
+
+	fields := []interface{}{
+		"id", event.ID(),
+		"source", event.Source(),
+		"type", event.Type(),
+		"outcome", d.outcome,
+		"duration_ms", float64(a.now().Sub(d.start).Microseconds()) / 1000,
+	}
+	if d.reason != "" {
+		fields = append(fields, "reason", d.reason)
+	}
+	if d.moref != "" {
+		fields = append(fields, "moref", d.moref, "cache_hit", d.cacheHit)
+	}
+	a.auditLog.Infow("event processed", fields...)
+}
+
+// newAuditLogger returns a JSON logger writing to a size-based rotating file.
+// The audit log is independent of the log level of the server.
+func newAuditLogger(path string, maxSize int64, maxBackups int) (*zap.SugaredLogger, *rotatingFile, error) {
+	f, err := newRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := zap.NewProductionEncoderConfig()
+	cfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(cfg), zapcore.AddSync(f), zapcore.InfoLevel)
+	return zap.New(core).Sugar(), f, nil
+}
+
+// rotatingFile is a file which is rotated when exceeding the max size. Rotated
+// files are renamed with an increasing numeric suffix, e.g. audit.log.1, and
+// the oldest file is removed when exceeding the max number of backups.
+type rotatingFile struct {
+	path       string
+	maxSize    int64 // bytes
+	maxBackups int
+
+	sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("create audit log directory: %w", err)
+	}
+
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open audit log: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("stat audit log: %w", err)
+	}
+
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups, renames the current file to the first backup and
+// opens a new file
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("close audit log: %w", err)
+	}
+	r.file = nil
+
+	if r.maxBackups == 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove audit log: %w", err)
+		}
+		return r.open()
+	}
+
+	_ = os.Remove(r.backup(r.maxBackups))
+	for i := r.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(r.backup(i), r.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("rotate audit log: %w", err)
+		}
+	}
+	if err := os.Rename(r.path, r.backup(1)); err != nil {
+		return fmt.Errorf("rotate audit log: %w", err)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", r.path, i)
+}
+
+func (r *rotatingFile) Sync() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Sync()
+}
+
+func (r *rotatingFile) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func Test_alarmServer_audit(t *testing.T) {
+	testEvents := createCloudEvents(t)
+
+	tests := []struct {
+		name      string
+		event     string
+		cached    bool
+		wantEntry map[string]interface{}
+	}{
+		{
+			name:   "enriched from cache",
+			event:  "AlarmStatusChangedEvent",
+			cached: true,
+			wantEntry: map[string]interface{}{
+				"msg":       "event processed",
+				"type":      "AlarmStatusChangedEvent",
+				"outcome":   outcomeEnriched,
+				"moref":     "Alarm:alarm-1",
+				"cache_hit": true,
+			},
+		},
+		{
+			name:   "failed retrieval",
+			event:  "AlarmStatusChangedEvent",
+			cached: false,
+			wantEntry: map[string]interface{}{
+				"msg":       "event processed",
+				"type":      "AlarmStatusChangedEvent",
+				"outcome":   outcomeFailed,
+				"reason":    string(failureVCenter),
+				"moref":     "Alarm:alarm-1",
+				"cache_hit": false,
+			},
+		},
+		{
+			name:  "ignored",
+			event: "VmPoweredOnEvent",
+			wantEntry: map[string]interface{}{
+				"msg":     "event processed",
+				"type":    "VmPoweredOnEvent",
+				"outcome": outcomeIgnored,
+				"reason":  reasonNotAlarm,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			core := zapcore.NewCore(zapcore.NewJSONEncoder(zapcore.EncoderConfig{MessageKey: "msg"}), zapcore.AddSync(&buf), zap.InfoLevel)
+
+			c := newAlarmCache(3600)
+			if tt.cached {
+				c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+			}
+
+			a := &alarmServer{
+				session:   newSession(nil, ""),
+				cache:     c,
+				clock:     clock.NewMock(),
+				source:    vc,
+				suffix:    "." + suffix,
+				injectKey: injectKey,
+				auditLog:  zap.New(core).Sugar(),
+			}
+			ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+			_, _ = a.handleEvent(ctx, *testEvents[tt.event])
+
+			var got map[string]interface{}
+			err := json.Unmarshal(buf.Bytes(), &got)
+			assert.NilError(t, err, "audit log: %s", buf.String())
+
+			tt.wantEntry["id"] = ""
+			tt.wantEntry["source"] = vc
+			tt.wantEntry["duration_ms"] = float64(0)
+			assert.DeepEqual(t, got, tt.wantEntry)
+		})
+	}
+}
+
+func Test_rotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit", "audit.log")
+
+	f, err := newRotatingFile(path, 10, 2)
+	assert.NilError(t, err)
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		_, err = f.Write([]byte(line))
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, f.Close())
+
+	read := func(name string) string {
+		b, err := ioutil.ReadFile(filepath.Join(dir, "audit", name))
+		assert.NilError(t, err)
+		return string(b)
+	}
+	assert.Equal(t, read("audit.log"), "dddddddd\n")
+	assert.Equal(t, read("audit.log.1"), "cccccccc\n")
+	assert.Equal(t, read("audit.log.2"), "bbbbbbbb\n")
+
+	_, err = os.Stat(filepath.Join(dir, "audit", "audit.log.3"))
+	assert.Assert(t, os.IsNotExist(err), "oldest backup must be removed")
+
+	// continue appending after restart
+	f, err = newRotatingFile(path, 100, 2)
+	assert.NilError(t, err)
+	_, err = f.Write([]byte("eeeeeeee\n"))
+	assert.NilError(t, err)
+	assert.NilError(t, f.Close())
+	assert.Assert(t, strings.HasPrefix(read("audit.log"), "dddddddd\n"))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+// errBreakerOpen is returned for vCenter calls rejected by an open circuit
+// breaker
+var errBreakerOpen = errors.New("vcenter unavailable: circuit breaker open")
+
+// breaker is a circuit breaker for vCenter calls. After threshold consecutive
+// failures the breaker opens and rejects calls until the cooldown has passed.
+// Then a single probe call is allowed (half-open) which closes the breaker on
+// success or opens it again on failure. A nil breaker allows all calls.
+type breaker struct {
+	clock     clock.Clock
+	threshold int
+	cooldown  time.Duration
+	onChange  func(from, to breakerState) // called with the breaker locked
+
+	sync.Mutex
+	state    breakerState
+	failures int // consecutive failures
+	since    time.Time
+	probing  bool
+}
+
+// breakerStatus is the admin representation of the circuit breaker
+type breakerStatus struct {
+	State    breakerState `json:"state"`
+	Failures int          `json:"failures"`
+	Since    time.Time    `json:"since"`
+}
+
+func newBreaker(threshold int, cooldown time.Duration, onChange func(from, to breakerState)) *breaker {
+	c := clock.New()
+	return &breaker{
+		clock:     c,
+		threshold: threshold,
+		cooldown:  cooldown,
+		onChange:  onChange,
+		state:     breakerClosed,
+		since:     c.Now().UTC(),
+	}
+}
+
+// allow returns whether a call may be performed. Every allowed call must be
+// followed by a call to record.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.clock.Since(b.since) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record records the result of an allowed call. Only errors signalling that
+// vCenter is unavailable count as failures. Cancelled calls, e.g. on shutdown,
+// say nothing about vCenter: failures are unchanged and a cancelled probe opens
+// the breaker again.
+func (b *breaker) record(err error) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.probing = false
+
+	if errors.Is(err, context.Canceled) {
+		if b.state == breakerHalfOpen {
+			b.setState(breakerOpen)
+		}
+		return
+	}
+
+	if !vcenterUnavailable(err) {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.setState(breakerOpen)
+	}
+}
+
+// status returns the current state of the breaker
+func (b *breaker) status() breakerStatus {
+	if b == nil {
+		return breakerStatus{State: breakerClosed}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	return breakerStatus{
+		State:    b.state,
+		Failures: b.failures,
+		Since:    b.since,
+	}
+}
+
+func (b *breaker) setState(s breakerState) {
+	from := b.state
+	b.state = s
+	b.since = b.clock.Now().UTC()
+	if b.onChange != nil {
+		b.onChange(from, s)
+	}
+}
+
+// vcenterUnavailable returns whether the specified error of a vCenter call
+// signals that vCenter is unavailable as opposed to a permanent fault of the
+// call itself, e.g. ManagedObjectNotFound. Calls before the initial connection
+// has been established count as unavailable.
+func vcenterUnavailable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	return errors.Is(err, errSessionLost) || errors.Is(err, errNotConnected) || isRetryable(err)
+}
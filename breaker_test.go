@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func Test_breaker(t *testing.T) {
+	var transitions []string
+	b := newBreaker(2, time.Second*30, func(from, to breakerState) {
+		transitions = append(transitions, string(from)+"->"+string(to))
+	})
+	mock := clock.NewMock()
+	b.clock = mock
+
+	unavailable := fmt.Errorf("giving up after 3 attempts: %w", context.DeadlineExceeded)
+	permanent := soap.WrapVimFault(&types.ManagedObjectNotFound{})
+
+	// permanent faults do not count
+	assert.Assert(t, b.allow())
+	b.record(permanent)
+	assert.Assert(t, b.allow())
+	b.record(unavailable)
+	assert.Equal(t, b.status().State, breakerClosed)
+
+	// open after threshold
+	assert.Assert(t, b.allow())
+	b.record(unavailable)
+	assert.Equal(t, b.status().State, breakerOpen)
+	assert.Assert(t, !b.allow())
+
+	// single probe after cooldown, failed probe opens again
+	mock.Add(time.Second * 30)
+	assert.Assert(t, b.allow())
+	assert.Equal(t, b.status().State, breakerHalfOpen)
+	assert.Assert(t, !b.allow())
+	b.record(unavailable)
+	assert.Equal(t, b.status().State, breakerOpen)
+	assert.Assert(t, !b.allow())
+
+	// successful probe closes
+	mock.Add(time.Second * 30)
+	assert.Assert(t, b.allow())
+	b.record(nil)
+	assert.Equal(t, b.status().State, breakerClosed)
+	assert.Equal(t, b.status().Failures, 0)
+	assert.Assert(t, b.allow())
+
+	assert.DeepEqual(t, transitions, []string{
+		"closed->open",
+		"open->half-open",
+		"half-open->open",
+		"open->half-open",
+		"half-open->closed",
+	})
+}
+
+func Test_breaker_canceled(t *testing.T) {
+	b := newBreaker(2, time.Second*30, nil)
+	mock := clock.NewMock()
+	b.clock = mock
+
+	unavailable := fmt.Errorf("giving up after 3 attempts: %w", context.DeadlineExceeded)
+	canceled := fmt.Errorf("retrieve alarm: %w", context.Canceled)
+
+	// cancellation does not reset failures
+	assert.Assert(t, b.allow())
+	b.record(unavailable)
+	assert.Assert(t, b.allow())
+	b.record(canceled)
+	assert.Equal(t, b.status().State, breakerClosed)
+	assert.Equal(t, b.status().Failures, 1)
+
+	assert.Assert(t, b.allow())
+	b.record(unavailable)
+	assert.Equal(t, b.status().State, breakerOpen)
+	assert.Equal(t, b.status().Failures, 2)
+
+	// cancelled probe does not close the breaker
+	mock.Add(time.Second * 30)
+	assert.Assert(t, b.allow())
+	assert.Equal(t, b.status().State, breakerHalfOpen)
+	b.record(canceled)
+	assert.Equal(t, b.status().State, breakerOpen)
+	assert.Equal(t, b.status().Failures, 2)
+	assert.Assert(t, !b.allow())
+
+	// next probe after cooldown
+	mock.Add(time.Second * 30)
+	assert.Assert(t, b.allow())
+	b.record(nil)
+	assert.Equal(t, b.status().State, breakerClosed)
+	assert.Equal(t, b.status().Failures, 0)
+}
+
+func Test_breaker_nil(t *testing.T) {
+	var b *breaker
+	assert.Assert(t, b.allow())
+	b.record(context.DeadlineExceeded)
+	assert.Equal(t, b.status().State, breakerClosed)
+}
+
+func Test_alarmServer_handleEvent_notConnected(t *testing.T) {
+	testEvents := createCloudEvents(t)
+	event := *testEvents["AlarmStatusChangedEvent"]
+
+	a := &alarmServer{
+		session:   newSession(nil, ""),
+		cache:     newAlarmCache(3600),
+		breaker:   newBreaker(2, time.Hour, nil),
+		source:    vc,
+		suffix:    "." + suffix,
+		injectKey: injectKey,
+		degraded:  ".Degraded",
+		policy:    failurePolicy{vcenter: actionPassthrough},
+	}
+	ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+	// events before the lazy connection open the breaker
+	for i := 0; i < 2; i++ {
+		got, result := a.handleEvent(ctx, event)
+		assert.Assert(t, result == nil, "result: %v", result)
+		assert.Assert(t, got != nil)
+		assert.Equal(t, got.Type(), "AlarmStatusChangedEvent."+suffix+".Degraded")
+	}
+	assert.Equal(t, a.breaker.status().State, breakerOpen)
+	assert.Equal(t, a.breaker.status().Failures, 2)
+
+	// rejected by the open breaker without calling vcenter
+	got, result := a.handleEvent(ctx, event)
+	assert.Assert(t, result == nil, "result: %v", result)
+	assert.Assert(t, got != nil)
+	assert.Equal(t, got.Type(), "AlarmStatusChangedEvent."+suffix+".Degraded")
+}
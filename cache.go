@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -15,10 +18,12 @@ const (
 )
 
 type cache struct {
-	clock clock.Clock
-	ttl   int64
+	clock  clock.Clock
+	ttl    int64
+	retain func() bool // optional, stale items are not purged while it returns true
 	sync.RWMutex
 	cache map[string]*item
+	gcAt  time.Time // last GC run, zero if the GC loop is not running
 }
 
 type item struct {
@@ -52,13 +57,84 @@ func (c *cache) get(key string) (mo.Alarm, bool) {
 	return mo.Alarm{}, false
 }
 
+// remove evicts the item with the specified key and returns whether it was
+// present
+func (c *cache) remove(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, ok := c.cache[key]
+	delete(c.cache, key)
+	return ok
+}
+
+// flush evicts all items and returns the number of evicted items
+func (c *cache) flush() int {
+	c.Lock()
+	defer c.Unlock()
+	n := len(c.cache)
+	c.cache = map[string]*item{}
+	return n
+}
+
+// keys returns the keys of all cached items in lexical order
+func (c *cache) keys() []string {
+	c.RLock()
+	defer c.RUnlock()
+	keys := make([]string, 0, len(c.cache))
+	for k := range c.cache {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// age returns the age in seconds of the item with the specified key
+func (c *cache) age(key string) (int64, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if k, ok := c.cache[key]; ok {
+		return c.clock.Now().UTC().Unix() - k.added, true
+	}
+	return 0, false
+}
+
+// gcCheck returns an error if the GC loop is not running or has not run for
+// several GC intervals
+func (c *cache) gcCheck() error {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.gcAt.IsZero() {
+		return errors.New("cache gc loop not running")
+	}
+	if since := c.clock.Since(c.gcAt); since > cacheGCInterval*cacheGCStallFactor {
+		return fmt.Errorf("cache gc loop stalled for %v", since.Truncate(time.Second))
+	}
+	return nil
+}
+
+func (c *cache) setGC(t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.gcAt = t
+}
+
 func (c *cache) run(ctx context.Context) error {
+	c.setGC(c.clock.Now())
+	defer c.setGC(time.Time{})
+
 	for {
 		select {
 		case <-ctx.Done():
 			logging.FromContext(ctx).Debugf("stopping alarm cache: %v", ctx.Err())
 			return ctx.Err()
 		case <-c.clock.Tick(cacheGCInterval):
+			c.setGC(c.clock.Now())
+			if c.retain != nil && c.retain() {
+				logging.FromContext(ctx).Debugf("retaining stale cache items")
+				continue
+			}
+
 			func() {
 				c.Lock()
 				defer c.Unlock()
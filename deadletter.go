@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/client"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// CloudEvents extension attributes set on dead-lettered events
+	errorReasonExtension = "errorreason"
+	errorClassExtension  = "errorclass"
+
+	deadLetterTimeout  = time.Second * 10
+	maxDeadLetterBytes = 10 * 1024 * 1024 // max size of a dead-lettered event in a file
+)
+
+// deadLetterSink preserves events which could not be enriched
+type deadLetterSink interface {
+	send(ctx context.Context, event cloudevents.Event) error
+	close() error
+}
+
+// newDeadLetterSink returns a dead-letter sink sending events to the specified
+// HTTP sink URL or appending them to the specified file. If both are empty, a
+// nil sink is returned.
+func newDeadLetterSink(sinkURL, file string) (deadLetterSink, error) {
+	switch {
+	case sinkURL != "" && file != "":
+		return nil, errors.New("DEADLETTER_SINK and DEADLETTER_FILE are mutually exclusive")
+	case sinkURL != "":
+		return newHTTPDeadLetter(sinkURL)
+	case file != "":
+		return newFileDeadLetter(file)
+	default:
+		return nil, nil
+	}
+}
+
+// deadLetter sends the specified event annotated with the failure class and
+// reason to the dead-letter sink (if configured). Errors are logged. Sending is
+// not cancelled with the event, e.g. when releases are cancelled on shutdown.
+// The deduplication keys of dead-lettered events are forgotten so that
+// resubmitted events are not ignored as duplicates.
+func (a *alarmServer) deadLetter(ctx context.Context, event cloudevents.Event, class failureClass, reason error) {
+	if a.deadLetters == nil {
+		return
+	}
+
+	dl := event.Clone()
+	dl.SetExtension(errorClassExtension, string(class))
+	dl.SetExtension(errorReasonExtension, reason.Error())
+
+	logger := logging.FromContext(ctx)
+	if err := a.deadLetters.send(detach(ctx, context.Background()), dl); err != nil {
+		logger.Errorw("send event to dead-letter sink", "id", event.ID(), "class", class, "error", err)
+		return
+	}
+	logger.Debugw("sent event to dead-letter sink", "id", event.ID(), "class", class)
+
+	if d := decisionFrom(ctx); d != nil {
+		a.dedup.forget(d.dedupKeys)
+	}
+}
+
+// httpDeadLetter sends dead-lettered events to an HTTP CloudEvents sink
+type httpDeadLetter struct {
+	target string
+	client client.Client
+}
+
+func newHTTPDeadLetter(target string) (*httpDeadLetter, error) {
+	c, err := cloudevents.NewClientHTTP()
+	if err != nil {
+		return nil, fmt.Errorf("create dead-letter cloudevents client: %w", err)
+	}
+	return &httpDeadLetter{target: target, client: c}, nil
+}
+
+func (h *httpDeadLetter) send(ctx context.Context, event cloudevents.Event) error {
+	ctx, cancel := context.WithTimeout(cloudevents.ContextWithTarget(ctx, h.target), deadLetterTimeout)
+	defer cancel()
+
+	if res := h.client.Send(ctx, event); !cloudevents.IsACK(res) {
+		return fmt.Errorf("send event to %s: %w", h.target, res)
+	}
+	return nil
+}
+
+func (h *httpDeadLetter) close() error {
+	return nil
+}
+
+// fileDeadLetter appends dead-lettered events in JSON format to a file, one
+// event per line
+type fileDeadLetter struct {
+	sync.Mutex
+	f *os.File
+}
+
+func newFileDeadLetter(path string) (*fileDeadLetter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open dead-letter file: %w", err)
+	}
+	return &fileDeadLetter{f: f}, nil
+}
+
+func (d *fileDeadLetter) send(_ context.Context, event cloudevents.Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if _, err = d.f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("write dead-letter file: %w", err)
+	}
+	return nil
+}
+
+func (d *fileDeadLetter) close() error {
+	d.Lock()
+	defer d.Unlock()
+	return d.f.Close()
+}
+
+// resubmit sends all events from the specified dead-letter file to target,
+// e.g. the broker, to pass them through the enrichment pipeline again. The
+// dead-letter extension attributes are removed before sending. Returns the
+// number of successfully resubmitted events.
+func resubmit(ctx context.Context, path, target string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("open dead-letter file: %w", err)
+	}
+	defer f.Close()
+
+	c, err := cloudevents.NewClientHTTP()
+	if err != nil {
+		return 0, fmt.Errorf("create cloudevents client: %w", err)
+	}
+	ctx = cloudevents.ContextWithTarget(ctx, target)
+
+	var (
+		sent   int
+		failed int
+		line   int
+	)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxDeadLetterBytes)
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var event cloudevents.Event
+		if err = json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return sent, fmt.Errorf("decode event in line %d: %w", line, err)
+		}
+
+		// remove dead-letter annotations (setting nil deletes the extension)
+		_ = event.Context.SetExtension(errorClassExtension, nil)
+		_ = event.Context.SetExtension(errorReasonExtension, nil)
+
+		if res := c.Send(ctx, event); !cloudevents.IsACK(res) {
+			logging.FromContext(ctx).Errorw("resubmit event", "id", event.ID(), "line", line, "error", res)
+			failed++
+			continue
+		}
+		sent++
+	}
+
+	if err = scanner.Err(); err != nil {
+		return sent, fmt.Errorf("read dead-letter file: %w", err)
+	}
+
+	if failed > 0 {
+		return sent, fmt.Errorf("failed to resubmit %d events", failed)
+	}
+	return sent, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func Test_alarmServer_deadLetter(t *testing.T) {
+	invalidEvent := cloudevents.NewEvent()
+	invalidEvent.SetID("1")
+	invalidEvent.SetSource(vc)
+	invalidEvent.SetType("AlarmStatusChangedEvent")
+	err := invalidEvent.SetData(cloudevents.ApplicationJSON, []byte(`{"Key":"not-a-number"}`))
+	assert.NilError(t, err)
+
+	t.Run("append to file and resubmit", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "deadletter.jsonl")
+		dl, err := newDeadLetterSink("", path)
+		assert.NilError(t, err)
+
+		a := &alarmServer{
+			source:      vc,
+			suffix:      "." + suffix,
+			deadLetters: dl,
+		}
+		ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+		for i := 0; i < 2; i++ {
+			got, result := a.handleEvent(ctx, invalidEvent)
+			assert.Assert(t, got == nil)
+			assert.Assert(t, result == nil)
+		}
+		assert.NilError(t, dl.close())
+
+		b, err := ioutil.ReadFile(path)
+		assert.NilError(t, err)
+		lines := bytes.Split(bytes.TrimSpace(b), []byte("\n"))
+		assert.Equal(t, len(lines), 2)
+
+		var event cloudevents.Event
+		err = json.Unmarshal(lines[0], &event)
+		assert.NilError(t, err)
+		assert.Equal(t, event.ID(), "1")
+		assert.Equal(t, event.Extensions()[errorClassExtension], string(failureDecode))
+		assert.Assert(t, event.Extensions()[errorReasonExtension] != "")
+
+		received := receiveEvents(t)
+		n, err := resubmit(ctx, path, received.url)
+		assert.NilError(t, err)
+		assert.Equal(t, n, 2)
+
+		events := received.get()
+		assert.Equal(t, len(events), 2)
+		assert.Equal(t, events[0].ID(), "1")
+		assert.Equal(t, len(events[0].Extensions()), 0)
+		assert.DeepEqual(t, events[0].Data(), invalidEvent.Data())
+	})
+
+	t.Run("send to http sink", func(t *testing.T) {
+		received := receiveEvents(t)
+		dl, err := newDeadLetterSink(received.url, "")
+		assert.NilError(t, err)
+
+		a := &alarmServer{
+			source:      vc,
+			suffix:      "." + suffix,
+			deadLetters: dl,
+			policy:      failurePolicy{decode: actionPassthrough},
+		}
+		ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+		got, result := a.handleEvent(ctx, invalidEvent)
+		assert.Assert(t, got != nil)
+		assert.Assert(t, result == nil)
+
+		events := received.get()
+		assert.Equal(t, len(events), 1)
+		assert.Equal(t, events[0].Extensions()[errorClassExtension], string(failureDecode))
+	})
+
+	t.Run("nack is not dead-lettered", func(t *testing.T) {
+		received := receiveEvents(t)
+		dl, err := newDeadLetterSink(received.url, "")
+		assert.NilError(t, err)
+
+		a := &alarmServer{
+			source:      vc,
+			suffix:      "." + suffix,
+			deadLetters: dl,
+			policy:      failurePolicy{decode: actionNACK},
+		}
+		ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+		_, result := a.handleEvent(ctx, invalidEvent)
+		assert.Assert(t, result != nil)
+		assert.Equal(t, len(received.get()), 0)
+	})
+
+	t.Run("resubmitted event is not a duplicate", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "deadletter.jsonl")
+		dl, err := newDeadLetterSink("", path)
+		assert.NilError(t, err)
+
+		b := newBreaker(1, time.Hour, nil)
+		b.allow()
+		b.record(context.DeadlineExceeded)
+
+		a := &alarmServer{
+			session:     newSession(nil, ""),
+			cache:       newAlarmCache(3600),
+			breaker:     b,
+			source:      vc,
+			suffix:      "." + suffix,
+			injectKey:   injectKey,
+			metrics:     newMetrics(),
+			dedup:       newDeduplicator(5*time.Minute, 100, false),
+			deadLetters: dl,
+			policy:      failurePolicy{vcenter: actionAck},
+		}
+		ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+		event := keyedEvent(t, 42, statusChanged("alarm-1", "host-1", "green", "red"))
+		got, result := a.handleEvent(ctx, event)
+		assert.Assert(t, got == nil)
+		assert.Assert(t, result == nil)
+		assert.NilError(t, dl.close())
+
+		// vcenter recovered, resubmit within the deduplication window
+		a.cache.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+		received := receiveEvents(t)
+		n, err := resubmit(ctx, path, received.url)
+		assert.NilError(t, err)
+		assert.Equal(t, n, 1)
+
+		events := received.get()
+		assert.Equal(t, len(events), 1)
+		got, result = a.handleEvent(ctx, events[0])
+		assert.Assert(t, result == nil)
+		assert.Assert(t, got != nil)
+		assert.Equal(t, a.metrics.events.get(outcomeIgnored, reasonDuplicate), float64(0))
+		assert.Equal(t, a.metrics.events.get(outcomeEnriched, ""), float64(1))
+
+		// the enriched event is remembered
+		got, result = a.handleEvent(ctx, events[0])
+		assert.Assert(t, result == nil)
+		assert.Assert(t, got == nil)
+		assert.Equal(t, a.metrics.events.get(outcomeIgnored, reasonDuplicate), float64(1))
+	})
+}
+
+// eventReceiver records the CloudEvents received by an HTTP test server
+type eventReceiver struct {
+	url string
+	sync.Mutex
+	events []cloudevents.Event
+}
+
+func (r *eventReceiver) get() []cloudevents.Event {
+	r.Lock()
+	defer r.Unlock()
+	return append([]cloudevents.Event{}, r.events...)
+}
+
+func receiveEvents(t *testing.T) *eventReceiver {
+	t.Helper()
+
+	r := eventReceiver{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		event, err := binding.ToEvent(req.Context(), cehttp.NewMessageFromHttpRequest(req))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		r.Lock()
+		r.events = append(r.events, *event)
+		r.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(srv.Close)
+
+	r.url = srv.URL
+	return &r
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/vmware/govmomi/vim25/types"
+	"knative.dev/pkg/logging"
+)
+
+// debounceAction is the result of holding a status transition
+type debounceAction int
+
+const (
+	debouncePassed     debounceAction = iota // not held, handled immediately
+	debounceHeld                             // held until stable for the delay
+	debounceSuppressed                       // reverted the held transition, both are dropped
+)
+
+// heldTransition carries the flapping state and deduplication keys recorded
+// when the held event was received to the release of the event
+type heldTransition struct {
+	transitions int
+	flapping    bool
+	dedupKeys   []string
+}
+
+type heldKey struct{}
+
+// heldFrom returns the held transition if the event handled with the context
+// is released after the debounce delay
+func heldFrom(ctx context.Context) (heldTransition, bool) {
+	h, ok := ctx.Value(heldKey{}).(heldTransition)
+	return h, ok
+}
+
+// heldEvent is the pending status transition of an alarm on an entity
+type heldEvent struct {
+	ctx        context.Context // detached context of the latest event
+	event      cloudevents.Event
+	from       string // status before the first held transition
+	transition heldTransition
+	timer      *clock.Timer
+}
+
+// debouncer holds status transitions of alarms per entity for a delay so that
+// only stable transitions are returned. A transition to one of the configured
+// statuses, e.g. red -> green, is held. If the alarm returns to the status
+// before the held transition within the delay, e.g. green -> red, both events
+// are dropped. Other transitions within the delay replace the held event and
+// restart the delay. Held events are released to the sinks once stable. Once
+// flushed, transitions are no longer held. A nil debouncer does not hold
+// transitions.
+type debouncer struct {
+	clock    clock.Clock
+	delay    time.Duration
+	statuses []string // new statuses of held transitions, all if empty
+	release  func(ctx context.Context, event cloudevents.Event, h heldTransition)
+
+	// releases are cancelled when the flush deadline passes
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	sync.Mutex
+	pending map[string]*heldEvent // keyed by alarm and entity moref
+	closed  bool                  // flushed
+	running sync.WaitGroup        // releases in progress
+}
+
+func newDebouncer(delay time.Duration, statuses []string) *debouncer {
+	var trimmed []string
+	for _, s := range statuses {
+		if s = strings.TrimSpace(s); s != "" {
+			trimmed = append(trimmed, s)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &debouncer{
+		clock:    clock.New(),
+		delay:    delay,
+		statuses: trimmed,
+		ctx:      ctx,
+		cancel:   cancel,
+		pending:  map[string]*heldEvent{},
+	}
+}
+
+// hold holds the status transition of the event unless it is not debounced
+func (d *debouncer) hold(ctx context.Context, event cloudevents.Event, changed types.AlarmStatusChangedEvent, h heldTransition) debounceAction {
+	key := changed.Alarm.Alarm.Value + "/" + changed.Entity.Entity.Value
+
+	d.Lock()
+	defer d.Unlock()
+
+	if d.closed {
+		return debouncePassed
+	}
+
+	p, ok := d.pending[key]
+	if ok {
+		p.timer.Stop()
+		if strings.EqualFold(changed.To, p.from) {
+			delete(d.pending, key)
+			return debounceSuppressed
+		}
+		p.ctx, p.event, p.transition = ctx, event, h
+	} else {
+		if !matchStatus(d.statuses, changed.To) {
+			return debouncePassed
+		}
+		p = &heldEvent{ctx: ctx, event: event, from: changed.From, transition: h}
+		d.pending[key] = p
+	}
+
+	var t *clock.Timer
+	t = d.clock.AfterFunc(d.delay, func() {
+		d.Lock()
+		// replaced, suppressed or flushed in the meantime
+		if cur, ok := d.pending[key]; d.closed || !ok || cur != p || cur.timer != t {
+			d.Unlock()
+			return
+		}
+		delete(d.pending, key)
+		d.running.Add(1)
+		d.Unlock()
+
+		defer d.running.Done()
+		d.release(detach(p.ctx, d.ctx), p.event, p.transition)
+	})
+	p.timer = t
+	return debounceHeld
+}
+
+// flush releases all held events concurrently and waits for all releases
+// including those after the delay which are already running, e.g. on shutdown.
+// When ctx is done, the releases are cancelled and send their events to the
+// dead-letter sink. Afterwards transitions are no longer held.
+func (d *debouncer) flush(ctx context.Context) {
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	d.closed = true
+	pending := d.pending
+	d.pending = map[string]*heldEvent{}
+	for _, p := range pending {
+		p.timer.Stop()
+		d.running.Add(1)
+		go func(p *heldEvent) {
+			defer d.running.Done()
+			d.release(detach(p.ctx, d.ctx), p.event, p.transition)
+		}(p)
+	}
+	d.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+	}
+	d.cancel()
+}
+
+// held returns the number of held events
+func (d *debouncer) held() int {
+	if d == nil {
+		return 0
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	return len(d.pending)
+}
+
+// hold holds the status transition of the alarm event for the debounce delay
+// and returns true if the event is held or suppressed. Held events are
+// acknowledged without response and released to the sinks once stable.
+func (a *alarmServer) hold(ctx context.Context, event cloudevents.Event, h heldTransition) bool {
+	if a.debounce == nil {
+		return false
+	}
+
+	// other alarm events do not change the status
+	var changed types.AlarmStatusChangedEvent
+	if err := event.DataAs(&changed); err != nil || changed.To == "" || changed.From == changed.To {
+		return false
+	}
+
+	logger := logging.FromContext(ctx)
+	d := decisionFrom(ctx)
+
+	// held events are released after the received event is acknowledged
+	switch a.debounce.hold(detach(ctx, context.Background()), event, changed, h) {
+	case debounceHeld:
+		logger.Debugw("holding alarm transition", "id", event.ID(), "from", changed.From, "to", changed.To, "delay", a.debounce.delay.String())
+		d.step("hold transition %s -> %s for %s", changed.From, changed.To, a.debounce.delay)
+		a.outcome(ctx, event, outcomeHeld, reasonDebounce)
+		return true
+	case debounceSuppressed:
+		logger.Debugw("suppressing reverted alarm transition", "id", event.ID(), "from", changed.From, "to", changed.To)
+		d.step("suppress transition %s -> %s reverting held transition", changed.From, changed.To)
+		a.outcome(ctx, event, outcomeSuppressed, reasonDebounce)
+		return true
+	default:
+		return false
+	}
+}
+
+// release handles the held event after the debounce delay and delivers the
+// response to the sinks. The received event was already acknowledged, thus
+// failures cannot be redelivered and are sent to the dead-letter sink.
+func (a *alarmServer) release(ctx context.Context, event cloudevents.Event, h heldTransition) {
+	d := &decision{start: a.now(), dedupKeys: h.dedupKeys}
+	ctx = context.WithValue(withDecision(ctx, d), heldKey{}, h)
+	defer a.record(event, d)
+	d.step("release held event")
+
+	ctx, span := a.startSpan(extractTrace(ctx, event), "release event")
+	resp, result := a.process(ctx, event)
+	if resp != nil && a.sinks != nil {
+		result = a.dispatch(ctx, event, resp)
+	}
+	endSpan(span, result)
+	if result == nil {
+		return
+	}
+
+	class := failureSink
+	if d.outcome == outcomeFailed {
+		class = failureClass(d.reason)
+	}
+	logging.FromContext(ctx).Errorw("could not release held event", "id", event.ID(), "class", class, "error", result)
+	a.deadLetter(ctx, event, class, result)
+}
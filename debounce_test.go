@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func Test_debouncer_hold(t *testing.T) {
+	type step struct {
+		wait         time.Duration // before holding
+		event        types.AlarmStatusChangedEvent
+		want         debounceAction
+		wantReleased []string // To status of released events after waiting
+	}
+
+	tests := []struct {
+		name     string
+		statuses []string
+		steps    []step
+	}{
+		{
+			name:     "released when stable",
+			statuses: []string{"green"},
+			steps: []step{
+				{event: statusChanged("alarm-1", "host-1", "red", "green"), want: debounceHeld},
+				{wait: 30 * time.Second, event: statusChanged("alarm-1", "host-2", "red", "green"), want: debounceHeld, wantReleased: []string{"green"}},
+			},
+		},
+		{
+			name:     "pair dropped when flipping back",
+			statuses: []string{"green"},
+			steps: []step{
+				{event: statusChanged("alarm-1", "host-1", "red", "green"), want: debounceHeld},
+				{wait: 10 * time.Second, event: statusChanged("alarm-1", "host-1", "green", "red"), want: debounceSuppressed},
+				// not held without pending transition
+				{wait: time.Minute, event: statusChanged("alarm-1", "host-1", "green", "red"), want: debouncePassed},
+			},
+		},
+		{
+			name:     "other transition replaces held event and restarts delay",
+			statuses: []string{"green"},
+			steps: []step{
+				{event: statusChanged("alarm-1", "host-1", "red", "green"), want: debounceHeld},
+				{wait: 20 * time.Second, event: statusChanged("alarm-1", "host-1", "green", "yellow"), want: debounceHeld},
+				{wait: 20 * time.Second, event: statusChanged("alarm-2", "host-1", "red", "green"), want: debounceHeld},
+				{wait: 10 * time.Second, event: statusChanged("alarm-3", "host-1", "yellow", "red"), want: debouncePassed, wantReleased: []string{"yellow"}},
+			},
+		},
+		{
+			name: "all statuses held if empty",
+			steps: []step{
+				{event: statusChanged("alarm-1", "host-1", "green", "red"), want: debounceHeld},
+				{event: statusChanged("alarm-1", "host-1", "red", "green"), want: debounceSuppressed},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				released []string
+			)
+			clk := clock.NewMock()
+			d := newDebouncer(30*time.Second, tt.statuses)
+			d.clock = clk
+			d.release = func(_ context.Context, event cloudevents.Event, _ heldTransition) {
+				var changed types.AlarmStatusChangedEvent
+				assert.NilError(t, event.DataAs(&changed))
+				mu.Lock()
+				released = append(released, changed.To)
+				mu.Unlock()
+			}
+
+			ctx := context.Background()
+			for i, s := range tt.steps {
+				mu.Lock()
+				released = nil
+				mu.Unlock()
+
+				clk.Add(s.wait)
+				got := d.hold(ctx, keyedEvent(t, int32(i+1), s.event), s.event, heldTransition{})
+				assert.Equal(t, got, s.want, "step %d", i)
+
+				mu.Lock()
+				assert.DeepEqual(t, released, s.wantReleased)
+				mu.Unlock()
+			}
+		})
+	}
+}
+
+func Test_debouncer_flush(t *testing.T) {
+	clk := clock.NewMock()
+	d := newDebouncer(30*time.Second, nil)
+	d.clock = clk
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	d.release = func(context.Context, cloudevents.Event, heldTransition) {
+		close(started)
+		<-unblock
+	}
+
+	event := statusChanged("alarm-1", "host-1", "red", "green")
+	assert.Equal(t, d.hold(context.Background(), keyedEvent(t, 1, event), event, heldTransition{}), debounceHeld)
+
+	// release after the delay is running
+	go clk.Add(30 * time.Second)
+	<-started
+
+	flushed := make(chan struct{})
+	go func() {
+		d.flush(context.Background())
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		t.Fatal("flush returned before the running release completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(unblock)
+	<-flushed
+
+	// not held after flush
+	event = statusChanged("alarm-1", "host-2", "red", "green")
+	assert.Equal(t, d.hold(context.Background(), keyedEvent(t, 2, event), event, heldTransition{}), debouncePassed)
+	assert.Equal(t, d.held(), 0)
+}
+
+func Test_debouncer_flush_deadline(t *testing.T) {
+	d := newDebouncer(30*time.Second, nil)
+	d.clock = clock.NewMock()
+
+	var (
+		started sync.WaitGroup
+		mu      sync.Mutex
+		errs    []error
+	)
+	started.Add(2)
+	d.release = func(ctx context.Context, _ cloudevents.Event, _ heldTransition) {
+		started.Done()
+		<-ctx.Done()
+		mu.Lock()
+		errs = append(errs, ctx.Err())
+		mu.Unlock()
+	}
+
+	for i, entity := range []string{"host-1", "host-2"} {
+		event := statusChanged("alarm-1", entity, "red", "green")
+		assert.Equal(t, d.hold(context.Background(), keyedEvent(t, int32(i+1), event), event, heldTransition{}), debounceHeld)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	flushed := make(chan struct{})
+	go func() {
+		d.flush(ctx)
+		close(flushed)
+	}()
+
+	// releases run concurrently
+	started.Wait()
+	select {
+	case <-flushed:
+		t.Fatal("flush returned before the deadline")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	<-flushed
+	assert.Equal(t, len(errs), 2)
+	for _, err := range errs {
+		assert.Equal(t, err, context.Canceled)
+	}
+}
+
+func Test_alarmServer_release_flushDeadline(t *testing.T) {
+	blocked := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-blocked:
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(hanging.Close)
+	t.Cleanup(func() { close(blocked) })
+
+	m := newMetrics()
+	s, err := newSinks([]string{hanging.URL}, nil, retryPolicy{attempts: 3, backoff: time.Millisecond}, m)
+	assert.NilError(t, err)
+	deadLetters := receiveEvents(t)
+	dl, err := newDeadLetterSink(deadLetters.url, "")
+	assert.NilError(t, err)
+
+	c := newAlarmCache(3600)
+	c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+
+	clk := clock.NewMock()
+	a := &alarmServer{
+		session:     newSession(nil, ""),
+		cache:       c,
+		clock:       clk,
+		source:      vc,
+		suffix:      "." + suffix,
+		injectKey:   injectKey,
+		metrics:     m,
+		sinks:       s,
+		deadLetters: dl,
+		debounce:    newDebouncer(time.Minute, []string{"green"}),
+	}
+	a.debounce.clock = clk
+	a.debounce.release = a.release
+	ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+	held := keyedEvent(t, 1, statusChanged("alarm-1", "host-1", "red", "green"))
+	resp, result := a.handleEvent(ctx, held)
+	assert.NilError(t, result)
+	assert.Assert(t, resp == nil)
+
+	flushCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	a.debounce.flush(flushCtx)
+
+	dead := deadLetters.get()
+	assert.Equal(t, len(dead), 1)
+	assert.DeepEqual(t, dead[0].Data(), held.Data())
+	assert.Equal(t, dead[0].Extensions()[errorClassExtension], string(failureSink))
+}
+
+func Test_alarmServer_handleEvent_debounce(t *testing.T) {
+	sink := receiveEvents(t)
+	m := newMetrics()
+	s, err := newSinks([]string{sink.url}, nil, retryPolicy{attempts: 1}, m)
+	assert.NilError(t, err)
+
+	c := newAlarmCache(3600)
+	c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+
+	clk := clock.NewMock()
+	a := &alarmServer{
+		session:   newSession(nil, ""),
+		cache:     c,
+		clock:     clk,
+		source:    vc,
+		suffix:    "." + suffix,
+		injectKey: injectKey,
+		metrics:   m,
+		sinks:     s,
+		debounce:  newDebouncer(time.Minute, []string{"green"}),
+	}
+	a.debounce.clock = clk
+	a.debounce.release = a.release
+	ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+	// held events are acknowledged without response
+	resolved := keyedEvent(t, 1, statusChanged("alarm-1", "host-1", "red", "green"))
+	resp, result := a.handleEvent(ctx, resolved)
+	assert.NilError(t, result)
+	assert.Assert(t, resp == nil)
+	assert.Equal(t, m.events.get(outcomeHeld, reasonDebounce), float64(1))
+	assert.Equal(t, len(sink.get()), 0)
+	assert.Equal(t, a.debounce.held(), 1)
+
+	clk.Add(time.Minute)
+	events := sink.get()
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].Type(), "AlarmStatusChangedEvent."+suffix)
+	assert.Equal(t, events[0].Extensions()[originalIDExtension], resolved.ID())
+	assert.Equal(t, m.events.get(outcomeEnriched, ""), float64(1))
+
+	// flipping back drops both events
+	resp, result = a.handleEvent(ctx, keyedEvent(t, 2, statusChanged("alarm-1", "host-1", "red", "green")))
+	assert.NilError(t, result)
+	assert.Assert(t, resp == nil)
+	clk.Add(30 * time.Second)
+	resp, result = a.handleEvent(ctx, keyedEvent(t, 3, statusChanged("alarm-1", "host-1", "green", "red")))
+	assert.NilError(t, result)
+	assert.Assert(t, resp == nil)
+	assert.Equal(t, m.events.get(outcomeSuppressed, reasonDebounce), float64(1))
+
+	clk.Add(time.Minute)
+	assert.Equal(t, len(sink.get()), 1)
+
+	// other transitions are delivered immediately
+	_, result = a.handleEvent(ctx, keyedEvent(t, 4, statusChanged("alarm-1", "host-1", "green", "red")))
+	assert.NilError(t, result)
+	assert.Equal(t, len(sink.get()), 2)
+
+	// held events are released on flush
+	_, result = a.handleEvent(ctx, keyedEvent(t, 5, statusChanged("alarm-1", "host-1", "red", "green")))
+	assert.NilError(t, result)
+	a.debounce.flush(context.Background())
+	assert.Equal(t, len(sink.get()), 3)
+	assert.Equal(t, a.debounce.held(), 0)
+
+	// the stopped timer does not release the event again
+	clk.Add(time.Minute)
+	assert.Equal(t, len(sink.get()), 3)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/vmware/govmomi/vim25/types"
+	"knative.dev/pkg/logging"
+)
+
+// deduplicator remembers the keys of recently handled events for a window to
+// ignore redelivered and repeated events. Events are keyed by the vCenter event
+// key and optionally by the alarm, entity and new status. The window starts
+// when a key is first seen. The number of remembered keys is bounded, the
+// oldest key is evicted when full. Keys are kept in the order they were first
+// seen so that expiry and eviction do not scan all keys. A nil deduplicator
+// does not deduplicate.
+type deduplicator struct {
+	clock        clock.Clock
+	window       time.Duration
+	size         int  // max remembered keys
+	byTransition bool // also key by alarm, entity and new status
+
+	sync.Mutex
+	seen  map[string]*list.Element // values are *seenKey
+	order *list.List               // oldest first
+}
+
+// seenKey is a remembered deduplication key
+type seenKey struct {
+	key   string
+	first time.Time
+}
+
+func newDeduplicator(window time.Duration, size int, byTransition bool) *deduplicator {
+	return &deduplicator{
+		clock:        clock.New(),
+		window:       window,
+		size:         size,
+		byTransition: byTransition,
+		seen:         map[string]*list.Element{},
+		order:        list.New(),
+	}
+}
+
+// keys returns the deduplication keys of the alarm event received from the
+// specified source
+func (d *deduplicator) keys(source string, event types.AlarmStatusChangedEvent) []string {
+	var keys []string
+	if event.Key != 0 {
+		keys = append(keys, fmt.Sprintf("key:%s/%d", source, event.Key))
+	}
+
+	// other alarm events do not change the status
+	if d.byTransition && event.To != "" {
+		keys = append(keys, fmt.Sprintf("transition:%s/%s/%s", event.Alarm.Alarm.Value, event.Entity.Entity.Value, event.To))
+	}
+	return keys
+}
+
+// check returns the first of the keys seen within the window and true if the
+// event is a duplicate. Otherwise the keys are remembered.
+func (d *deduplicator) check(keys []string) (string, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	now := d.clock.Now()
+	d.expire(now)
+	for _, k := range keys {
+		if _, ok := d.seen[k]; ok {
+			return k, true
+		}
+	}
+
+	for _, k := range keys {
+		if len(d.seen) >= d.size {
+			d.remove(d.order.Front())
+		}
+		d.seen[k] = d.order.PushBack(&seenKey{key: k, first: now})
+	}
+	return "", false
+}
+
+// forget removes the keys, e.g. when the event is rejected and will be
+// redelivered
+func (d *deduplicator) forget(keys []string) {
+	if d == nil || len(keys) == 0 {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	for _, k := range keys {
+		if e, ok := d.seen[k]; ok {
+			d.remove(e)
+		}
+	}
+}
+
+// expire removes the keys seen before the window, oldest first. The lock must
+// be held.
+func (d *deduplicator) expire(now time.Time) {
+	for e := d.order.Front(); e != nil && now.Sub(e.Value.(*seenKey).first) >= d.window; e = d.order.Front() {
+		d.remove(e)
+	}
+}
+
+// remove removes the key of the element. The lock must be held.
+func (d *deduplicator) remove(e *list.Element) {
+	delete(d.seen, e.Value.(*seenKey).key)
+	d.order.Remove(e)
+}
+
+// duplicate returns the matching key and true if the alarm event was already
+// handled within the deduplication window. Otherwise the keys of the event are
+// remembered in the decision to release them if the event is rejected.
+func (a *alarmServer) duplicate(ctx context.Context, event cloudevents.Event) (string, bool) {
+	if a.dedup == nil {
+		return "", false
+	}
+
+	var alarmEvent types.AlarmStatusChangedEvent
+	if err := event.DataAs(&alarmEvent); err != nil {
+		logging.FromContext(ctx).Debugw("could not decode event for deduplication", "id", event.ID(), "error", err)
+		return "", false
+	}
+
+	keys := a.dedup.keys(event.Source(), alarmEvent)
+	if key, dup := a.dedup.check(keys); dup {
+		return key, true
+	}
+
+	if d := decisionFrom(ctx); d != nil {
+		d.dedupKeys = keys
+	}
+	return "", false
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func keyedEvent(t *testing.T, key int32, event types.AlarmStatusChangedEvent) cloudevents.Event {
+	t.Helper()
+
+	event.Key = key
+	ce := cloudevents.NewEvent()
+	ce.SetSource(vc)
+	ce.SetType("AlarmStatusChangedEvent")
+	err := ce.SetData(cloudevents.ApplicationJSON, event)
+	assert.NilError(t, err)
+	return ce
+}
+
+func Test_deduplicator_check(t *testing.T) {
+	type step struct {
+		wait    time.Duration // before checking
+		key     int32
+		event   types.AlarmStatusChangedEvent
+		wantDup bool
+	}
+
+	tests := []struct {
+		name         string
+		byTransition bool
+		size         int
+		steps        []step
+	}{
+		{
+			name: "same key within window",
+			steps: []step{
+				{key: 1, event: statusChanged("alarm-1", "host-1", "green", "red")},
+				{wait: time.Minute, key: 1, event: statusChanged("alarm-1", "host-1", "green", "red"), wantDup: true},
+				{key: 2, event: statusChanged("alarm-1", "host-1", "green", "red")},
+			},
+		},
+		{
+			name: "same key after window",
+			steps: []step{
+				{key: 1, event: statusChanged("alarm-1", "host-1", "green", "red")},
+				{wait: 5 * time.Minute, key: 1, event: statusChanged("alarm-1", "host-1", "green", "red")},
+				// the window restarts
+				{wait: 4 * time.Minute, key: 1, event: statusChanged("alarm-1", "host-1", "green", "red"), wantDup: true},
+			},
+		},
+		{
+			name:         "same transition within window",
+			byTransition: true,
+			steps: []step{
+				{key: 1, event: statusChanged("alarm-1", "host-1", "green", "red")},
+				{key: 2, event: statusChanged("alarm-1", "host-1", "yellow", "red"), wantDup: true},
+				{key: 3, event: statusChanged("alarm-1", "host-2", "green", "red")},
+				{key: 4, event: statusChanged("alarm-1", "host-1", "red", "green")},
+			},
+		},
+		{
+			name: "transition ignored by default",
+			steps: []step{
+				{key: 1, event: statusChanged("alarm-1", "host-1", "green", "red")},
+				{key: 2, event: statusChanged("alarm-1", "host-1", "green", "red")},
+			},
+		},
+		{
+			name: "events without key are not deduplicated",
+			steps: []step{
+				{event: statusChanged("alarm-1", "host-1", "green", "red")},
+				{event: statusChanged("alarm-1", "host-1", "green", "red")},
+			},
+		},
+		{
+			name: "oldest key evicted when full",
+			size: 2,
+			steps: []step{
+				{key: 1, event: statusChanged("alarm-1", "host-1", "green", "red")},
+				{wait: time.Second, key: 2, event: statusChanged("alarm-1", "host-1", "green", "red")},
+				{wait: time.Second, key: 3, event: statusChanged("alarm-1", "host-1", "green", "red")},
+				{key: 2, event: statusChanged("alarm-1", "host-1", "green", "red"), wantDup: true},
+				{key: 1, event: statusChanged("alarm-1", "host-1", "green", "red")},
+			},
+		},
+		{
+			name: "expired key removed before evicting",
+			size: 2,
+			steps: []step{
+				{key: 1, event: statusChanged("alarm-1", "host-1", "green", "red")},
+				{wait: 4 * time.Minute, key: 2, event: statusChanged("alarm-1", "host-1", "green", "red")},
+				{wait: time.Minute, key: 3, event: statusChanged("alarm-1", "host-1", "green", "red")},
+				{key: 2, event: statusChanged("alarm-1", "host-1", "green", "red"), wantDup: true},
+				{key: 3, event: statusChanged("alarm-1", "host-1", "green", "red"), wantDup: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := tt.size
+			if size == 0 {
+				size = 100
+			}
+			clk := clock.NewMock()
+			d := newDeduplicator(5*time.Minute, size, tt.byTransition)
+			d.clock = clk
+
+			for i, s := range tt.steps {
+				clk.Add(s.wait)
+				s.event.Key = s.key
+				_, dup := d.check(d.keys(vc, s.event))
+				assert.Equal(t, dup, s.wantDup, "step %d", i)
+				assert.Assert(t, len(d.seen) <= size)
+				assert.Equal(t, len(d.seen), d.order.Len())
+			}
+		})
+	}
+}
+
+func Test_alarmServer_handleEvent_dedup(t *testing.T) {
+	c := newAlarmCache(3600)
+	c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+
+	d := newDeduplicator(5*time.Minute, 100, false)
+	clk := clock.NewMock()
+	d.clock = clk
+
+	a := &alarmServer{
+		session:   newSession(nil, ""),
+		cache:     c,
+		clock:     clk,
+		source:    vc,
+		suffix:    "." + suffix,
+		injectKey: injectKey,
+		metrics:   newMetrics(),
+		dedup:     d,
+	}
+	ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+	event := keyedEvent(t, 42, statusChanged("alarm-1", "host-1", "green", "red"))
+	resp, result := a.handleEvent(ctx, event)
+	assert.NilError(t, result)
+	assert.Assert(t, resp != nil)
+
+	// redelivered event is acknowledged without response
+	resp, result = a.handleEvent(ctx, event)
+	assert.NilError(t, result)
+	assert.Assert(t, resp == nil)
+	assert.Equal(t, a.metrics.events.get(outcomeIgnored, reasonDuplicate), float64(1))
+
+	clk.Add(5 * time.Minute)
+	resp, result = a.handleEvent(ctx, event)
+	assert.NilError(t, result)
+	assert.Assert(t, resp != nil)
+
+	// rejected events are not remembered
+	url, _ := rejectEvents(t, http.StatusBadRequest)
+	s, err := newSinks([]string{url}, nil, retryPolicy{attempts: 1}, a.metrics)
+	assert.NilError(t, err)
+	a.sinks, a.policy = s, failurePolicy{sink: actionNACK}
+
+	rejected := keyedEvent(t, 43, statusChanged("alarm-1", "host-1", "red", "green"))
+	_, result = a.handleEvent(ctx, rejected)
+	assert.Assert(t, result != nil)
+	_, result = a.handleEvent(ctx, rejected)
+	assert.Assert(t, result != nil)
+	assert.Equal(t, a.metrics.events.get(outcomeIgnored, reasonDuplicate), float64(1))
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/vmware/govmomi/vim25/types"
+	"knative.dev/pkg/logging"
+)
+
+// digestGroupBy selects how enriched alarm events are grouped into digests
+type digestGroupBy string
+
+const (
+	digestComputeResource digestGroupBy = "computeresource" // cluster or standalone host
+	digestDatacenter      digestGroupBy = "datacenter"
+	digestAlarm           digestGroupBy = "alarm" // alarm name
+)
+
+func parseDigestGroupBy(s string) (digestGroupBy, error) {
+	switch g := digestGroupBy(s); g {
+	case digestComputeResource, digestDatacenter, digestAlarm:
+		return g, nil
+	default:
+		return "", fmt.Errorf("invalid DIGEST_GROUP_BY %q: must be %q, %q or %q", s, digestComputeResource, digestDatacenter, digestAlarm)
+	}
+}
+
+// group returns the group of the alarm event with the specified alarm name,
+// empty if the event does not carry the grouping attribute
+func (g digestGroupBy) group(event types.AlarmStatusChangedEvent, alarm string) string {
+	switch g {
+	case digestComputeResource:
+		if cr := event.ComputeResource; cr != nil {
+			if cr.Name != "" {
+				return cr.Name
+			}
+			return cr.ComputeResource.Value
+		}
+	case digestDatacenter:
+		if dc := event.Datacenter; dc != nil {
+			if dc.Name != "" {
+				return dc.Name
+			}
+			return dc.Datacenter.Value
+		}
+	case digestAlarm:
+		if alarm != "" {
+			return alarm
+		}
+		return event.Alarm.Name
+	}
+	return ""
+}
+
+// alarmDigest is the data of a digest event summarizing the enriched alarm
+// events of a group within a window
+type alarmDigest struct {
+	GroupBy  digestGroupBy   `json:"groupBy"`
+	Group    string          `json:"group"`
+	Start    time.Time       `json:"start"`
+	End      time.Time       `json:"end"`
+	Events   int             `json:"events"`
+	Alarms   map[string]int  `json:"alarms"`   // events by alarm name
+	Entities []*digestEntity `json:"entities"` // most events first
+	Omitted  int             `json:"omittedEntities,omitempty"`
+}
+
+// digestEntity is an entity affected by the alarms of a digest
+type digestEntity struct {
+	Name   string `json:"name"`
+	Entity string `json:"entity"`           // moref
+	Status string `json:"status,omitempty"` // latest status
+	Events int    `json:"events"`
+}
+
+// pendingDigest is a digest collecting events until the window ends
+type pendingDigest struct {
+	ctx      context.Context // detached context of the first event
+	digest   *alarmDigest
+	entities map[string]*digestEntity // keyed by entity moref
+}
+
+// digester aggregates enriched alarm events by group over a window and emits a
+// single digest per group when the window ends. The window starts with the
+// first event of a group. The number of listed entities per digest is
+// bounded, further entities are only counted. Once flushed, events are no
+// longer aggregated. A nil digester does not aggregate.
+type digester struct {
+	clock       clock.Clock
+	window      time.Duration
+	groupBy     digestGroupBy
+	maxEntities int
+	individual  bool   // also return the individual events
+	eventType   string // of digest events
+	emit        func(ctx context.Context, digest *alarmDigest)
+
+	// emits are cancelled when the flush deadline passes
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	sync.Mutex
+	pending map[string]*pendingDigest // keyed by group
+	closed  bool                      // flushed
+	running sync.WaitGroup            // digests being emitted
+}
+
+func newDigester(window time.Duration, groupBy digestGroupBy, maxEntities int, individual bool, eventType string) *digester {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &digester{
+		clock:       clock.New(),
+		window:      window,
+		groupBy:     groupBy,
+		maxEntities: maxEntities,
+		individual:  individual,
+		eventType:   eventType,
+		ctx:         ctx,
+		cancel:      cancel,
+		pending:     map[string]*pendingDigest{},
+	}
+}
+
+// add adds the alarm event to the digest of its group and returns the group,
+// empty if the event has no group and is not aggregated
+func (d *digester) add(ctx context.Context, event types.AlarmStatusChangedEvent, alarm string) string {
+	group := d.groupBy.group(event, alarm)
+	if group == "" {
+		return ""
+	}
+	if alarm == "" {
+		alarm = event.Alarm.Name
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if d.closed {
+		return ""
+	}
+
+	p, ok := d.pending[group]
+	if !ok {
+		p = &pendingDigest{
+			ctx: ctx,
+			digest: &alarmDigest{
+				GroupBy: d.groupBy,
+				Group:   group,
+				Start:   d.clock.Now().UTC(),
+				Alarms:  map[string]int{},
+			},
+			entities: map[string]*digestEntity{},
+		}
+		d.pending[group] = p
+		d.clock.AfterFunc(d.window, func() {
+			d.Lock()
+			// flushed in the meantime
+			if cur, ok := d.pending[group]; d.closed || !ok || cur != p {
+				d.Unlock()
+				return
+			}
+			delete(d.pending, group)
+			d.running.Add(1)
+			d.Unlock()
+
+			defer d.running.Done()
+			d.emit(detach(p.ctx, d.ctx), d.complete(p))
+		})
+	}
+
+	p.digest.Events++
+	p.digest.Alarms[alarm]++
+
+	moref := event.Entity.Entity.String()
+	e, ok := p.entities[moref]
+	if !ok {
+		if len(p.entities) >= d.maxEntities {
+			p.digest.Omitted++
+			return group
+		}
+		e = &digestEntity{Name: event.Entity.Name, Entity: moref}
+		p.entities[moref] = e
+	}
+	e.Events++
+	if event.To != "" {
+		e.Status = event.To
+	}
+	return group
+}
+
+// complete ends the window of the digest, must not be called while the digest
+// is pending
+func (d *digester) complete(p *pendingDigest) *alarmDigest {
+	digest := p.digest
+	digest.End = d.clock.Now().UTC()
+	digest.Entities = make([]*digestEntity, 0, len(p.entities))
+	for _, e := range p.entities {
+		digest.Entities = append(digest.Entities, e)
+	}
+	sort.Slice(digest.Entities, func(i, j int) bool {
+		a, b := digest.Entities[i], digest.Entities[j]
+		if a.Events != b.Events {
+			return a.Events > b.Events
+		}
+		return a.Entity < b.Entity
+	})
+	return digest
+}
+
+// flush emits all pending digests concurrently and waits for all emits
+// including those at the end of the window which are already running, e.g. on
+// shutdown. When ctx is done, the emits are cancelled. Afterwards events are no
+// longer aggregated.
+func (d *digester) flush(ctx context.Context) {
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	d.closed = true
+	pending := d.pending
+	d.pending = map[string]*pendingDigest{}
+	for _, p := range pending {
+		digest := d.complete(p)
+		d.running.Add(1)
+		go func(p *pendingDigest) {
+			defer d.running.Done()
+			d.emit(detach(p.ctx, d.ctx), digest)
+		}(p)
+	}
+	d.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+	}
+	d.cancel()
+}
+
+// own returns true if the type is the type of digest events
+func (d *digester) own(eventType string) bool {
+	return d != nil && eventType == d.eventType
+}
+
+// aggregate adds the enriched alarm event to its digest and returns the
+// response unless individual events are disabled
+func (a *alarmServer) aggregate(ctx context.Context, event cloudevents.Event, resp *cloudevents.Event) *cloudevents.Event {
+	d := decisionFrom(ctx)
+	if a.digests == nil || resp == nil || d == nil || d.outcome != outcomeEnriched {
+		return resp
+	}
+
+	var alarmEvent types.AlarmStatusChangedEvent
+	if err := event.DataAs(&alarmEvent); err != nil {
+		return resp
+	}
+
+	group := a.digests.add(detach(ctx, context.Background()), alarmEvent, d.alarm)
+	if group == "" {
+		d.step("not aggregated: no %s", a.digests.groupBy)
+		return resp
+	}
+
+	d.step("aggregate into digest of %s %s", a.digests.groupBy, group)
+	if a.digests.individual {
+		return resp
+	}
+	d.output = nil
+	return nil
+}
+
+// dispatch delivers the response to the sinks and adds it to its digest. If
+// the digest replaces the individual events, the response is only aggregated.
+// Otherwise it is aggregated once all sinks accepted it, so that events
+// redelivered or resubmitted from the dead-letter sink are not counted twice.
+func (a *alarmServer) dispatch(ctx context.Context, event cloudevents.Event, resp *cloudevents.Event) cloudevents.Result {
+	if a.digests != nil && !a.digests.individual {
+		if resp = a.aggregate(ctx, event, resp); resp == nil {
+			return nil
+		}
+		_, result := a.deliver(ctx, event, resp)
+		return result
+	}
+
+	delivered, result := a.deliver(ctx, event, resp)
+	if delivered {
+		a.aggregate(ctx, event, resp)
+	}
+	return result
+}
+
+// emitDigest sends the digest event to the sinks
+func (a *alarmServer) emitDigest(ctx context.Context, digest *alarmDigest) {
+	logger := logging.FromContext(ctx)
+
+	event := cloudevents.NewEvent()
+	event.SetSource(a.source)
+	event.SetType(a.digests.eventType)
+	event.SetSubject(digest.Group)
+	// same ID and time for all sinks and retries
+	identify(&event, digest.End)
+	if err := event.SetData(cloudevents.ApplicationJSON, digest); err != nil {
+		logger.Errorw("could not encode digest", "group", digest.Group, "error", err)
+		return
+	}
+
+	failed := a.sinks.send(ctx, event)
+	for target, err := range failed {
+		logger.Errorw("could not deliver digest to sink", "group", digest.Group, "sink", target, "error", err)
+	}
+	if len(failed) == 0 {
+		logger.Debugw("emitted digest", "group", digest.Group, "events", digest.Events, "entities", len(digest.Entities))
+	}
+}
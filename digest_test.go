@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+// clusterChanged returns a status change of the alarm on the host in the
+// cluster
+func clusterChanged(alarm, host, cluster, to string) types.AlarmStatusChangedEvent {
+	event := statusChanged(alarm, host, "green", to)
+	event.Alarm.Name = alarm
+	event.ComputeResource = &types.ComputeResourceEventArgument{
+		EntityEventArgument: types.EntityEventArgument{Name: cluster},
+		ComputeResource:     types.ManagedObjectReference{Type: "ClusterComputeResource", Value: "domain-" + cluster},
+	}
+	event.Datacenter = &types.DatacenterEventArgument{
+		EntityEventArgument: types.EntityEventArgument{Name: "dc-1"},
+		Datacenter:          types.ManagedObjectReference{Type: "Datacenter", Value: "datacenter-1"},
+	}
+	return event
+}
+
+func Test_parseDigestGroupBy(t *testing.T) {
+	g, err := parseDigestGroupBy("datacenter")
+	assert.NilError(t, err)
+	assert.Equal(t, g, digestDatacenter)
+
+	_, err = parseDigestGroupBy("cluster")
+	assert.ErrorContains(t, err, `invalid DIGEST_GROUP_BY "cluster"`)
+}
+
+func Test_digester_add(t *testing.T) {
+	tests := []struct {
+		name        string
+		groupBy     digestGroupBy
+		maxEntities int
+		events      []types.AlarmStatusChangedEvent
+		want        []alarmDigest // without entities and window
+		wantHosts   [][]string    // entity names per digest
+	}{
+		{
+			name:        "by compute resource",
+			groupBy:     digestComputeResource,
+			maxEntities: 10,
+			events: []types.AlarmStatusChangedEvent{
+				clusterChanged("alarm-1", "host-1", "cluster-1", "yellow"),
+				clusterChanged("alarm-2", "host-2", "cluster-1", "red"),
+				clusterChanged("alarm-1", "host-2", "cluster-1", "red"),
+				clusterChanged("alarm-1", "host-3", "cluster-2", "red"),
+				statusChanged("alarm-1", "host-4", "green", "red"), // standalone event without compute resource
+			},
+			want: []alarmDigest{
+				{GroupBy: digestComputeResource, Group: "cluster-1", Events: 3, Alarms: map[string]int{"alarm-1": 2, "alarm-2": 1}},
+				{GroupBy: digestComputeResource, Group: "cluster-2", Events: 1, Alarms: map[string]int{"alarm-1": 1}},
+			},
+			wantHosts: [][]string{{"host-2", "host-1"}, {"host-3"}},
+		},
+		{
+			name:        "by datacenter with bounded entities",
+			groupBy:     digestDatacenter,
+			maxEntities: 2,
+			events: []types.AlarmStatusChangedEvent{
+				clusterChanged("alarm-1", "host-1", "cluster-1", "red"),
+				clusterChanged("alarm-1", "host-2", "cluster-1", "red"),
+				clusterChanged("alarm-1", "host-3", "cluster-2", "red"),
+				clusterChanged("alarm-1", "host-1", "cluster-1", "green"),
+			},
+			want: []alarmDigest{
+				{GroupBy: digestDatacenter, Group: "dc-1", Events: 4, Alarms: map[string]int{"alarm-1": 4}, Omitted: 1},
+			},
+			wantHosts: [][]string{{"host-1", "host-2"}},
+		},
+		{
+			name:        "by alarm",
+			groupBy:     digestAlarm,
+			maxEntities: 10,
+			events: []types.AlarmStatusChangedEvent{
+				clusterChanged("alarm-1", "host-1", "cluster-1", "red"),
+				clusterChanged("alarm-1", "host-2", "cluster-2", "red"),
+			},
+			want: []alarmDigest{
+				{GroupBy: digestAlarm, Group: "alarm-1", Events: 2, Alarms: map[string]int{"alarm-1": 2}},
+			},
+			wantHosts: [][]string{{"host-1", "host-2"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clk := clock.NewMock()
+			d := newDigester(time.Minute, tt.groupBy, tt.maxEntities, true, "com.vmware.vsphere.alarm.digest")
+			d.clock = clk
+
+			var emitted []*alarmDigest
+			d.emit = func(_ context.Context, digest *alarmDigest) {
+				emitted = append(emitted, digest)
+			}
+
+			start := clk.Now().UTC()
+			for _, e := range tt.events {
+				d.add(context.Background(), e, "")
+				clk.Add(time.Second)
+			}
+			assert.Equal(t, len(emitted), 0, "emitted before window ended")
+
+			clk.Add(time.Minute)
+			assert.Equal(t, len(emitted), len(tt.want))
+
+			byGroup := map[string]*alarmDigest{}
+			for _, e := range emitted {
+				byGroup[e.Group] = e
+			}
+			for i, want := range tt.want {
+				got, ok := byGroup[want.Group]
+				assert.Assert(t, ok, "no digest for %s", want.Group)
+				assert.Equal(t, got.GroupBy, want.GroupBy)
+				assert.Equal(t, got.Events, want.Events)
+				assert.DeepEqual(t, got.Alarms, want.Alarms)
+				assert.Equal(t, got.Omitted, want.Omitted)
+				assert.Equal(t, got.End.Sub(got.Start), time.Minute)
+				assert.Assert(t, !got.Start.Before(start))
+
+				var hosts []string
+				for _, e := range got.Entities {
+					hosts = append(hosts, e.Name)
+				}
+				assert.DeepEqual(t, hosts, tt.wantHosts[i])
+			}
+		})
+	}
+}
+
+func Test_digester_flush(t *testing.T) {
+	clk := clock.NewMock()
+	d := newDigester(time.Minute, digestComputeResource, 10, true, "com.vmware.vsphere.alarm.digest")
+	d.clock = clk
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	d.emit = func(context.Context, *alarmDigest) {
+		close(started)
+		<-unblock
+	}
+
+	group := d.add(context.Background(), clusterChanged("alarm-1", "host-1", "cluster-1", "red"), "")
+	assert.Equal(t, group, "cluster-1")
+
+	// digest emitted when the window ends
+	go clk.Add(time.Minute)
+	<-started
+
+	flushed := make(chan struct{})
+	go func() {
+		d.flush(context.Background())
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		t.Fatal("flush returned before the running emit completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(unblock)
+	<-flushed
+
+	// not aggregated after flush
+	group = d.add(context.Background(), clusterChanged("alarm-1", "host-2", "cluster-1", "red"), "")
+	assert.Equal(t, group, "")
+}
+
+func Test_alarmServer_handleEvent_digest(t *testing.T) {
+	tests := []struct {
+		name       string
+		individual bool
+	}{
+		{name: "digest and individual events", individual: true},
+		{name: "digest only", individual: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := receiveEvents(t)
+			other := receiveEvents(t)
+			m := newMetrics()
+			s, err := newSinks([]string{sink.url, other.url}, nil, retryPolicy{attempts: 1}, m)
+			assert.NilError(t, err)
+
+			c := newAlarmCache(3600)
+			c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+
+			clk := clock.NewMock()
+			a := &alarmServer{
+				session:   newSession(nil, ""),
+				cache:     c,
+				clock:     clk,
+				source:    vc,
+				suffix:    "." + suffix,
+				injectKey: injectKey,
+				metrics:   m,
+				sinks:     s,
+				digests:   newDigester(time.Minute, digestComputeResource, 10, tt.individual, "com.vmware.vsphere.alarm.digest"),
+			}
+			a.digests.clock = clk
+			a.digests.emit = a.emitDigest
+			ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+			for i, host := range []string{"host-1", "host-2", "host-3"} {
+				_, result := a.handleEvent(ctx, keyedEvent(t, int32(i+1), clusterChanged("alarm-1", host, "cluster-1", "red")))
+				assert.NilError(t, result)
+			}
+
+			individual := 0
+			if tt.individual {
+				individual = 3
+			}
+			assert.Equal(t, len(sink.get()), individual)
+
+			clk.Add(time.Minute)
+			events := sink.get()
+			assert.Equal(t, len(events), individual+1)
+
+			digest := events[len(events)-1]
+			assert.Equal(t, digest.Type(), "com.vmware.vsphere.alarm.digest")
+			assert.Equal(t, digest.Source(), vc)
+			assert.Equal(t, digest.Subject(), "cluster-1")
+			assert.Assert(t, digest.ID() != "")
+			assert.Equal(t, digest.Time(), clk.Now().UTC())
+
+			// same digest event for all sinks
+			others := other.get()
+			assert.Equal(t, others[len(others)-1].ID(), digest.ID())
+
+			var data alarmDigest
+			assert.NilError(t, digest.DataAs(&data))
+			assert.Equal(t, data.Events, 3)
+			// alarm name of the enriched alarm info
+			assert.DeepEqual(t, data.Alarms, map[string]int{"alarm-1": 3})
+			assert.Equal(t, len(data.Entities), 3)
+			assert.Equal(t, data.Entities[0].Entity, "HostSystem:host-1")
+			assert.Equal(t, data.Entities[0].Status, "red")
+
+			// digests are not aggregated again
+			resp, result := a.handleEvent(ctx, digest)
+			assert.NilError(t, result)
+			assert.Assert(t, resp == nil)
+			assert.Equal(t, m.events.get(outcomeIgnored, reasonSelf), float64(1))
+		})
+	}
+}
+
+func Test_alarmServer_handleEvent_digestRedelivery(t *testing.T) {
+	sink := receiveEvents(t)
+	flaky := flakyEvents(t, 1)
+	m := newMetrics()
+	s, err := newSinks([]string{sink.url, flaky.url}, nil, retryPolicy{attempts: 1}, m)
+	assert.NilError(t, err)
+
+	c := newAlarmCache(3600)
+	c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+
+	clk := clock.NewMock()
+	a := &alarmServer{
+		session:   newSession(nil, ""),
+		cache:     c,
+		clock:     clk,
+		source:    vc,
+		suffix:    "." + suffix,
+		injectKey: injectKey,
+		metrics:   m,
+		sinks:     s,
+		policy:    failurePolicy{sink: actionNACK},
+		digests:   newDigester(time.Minute, digestComputeResource, 10, true, "com.vmware.vsphere.alarm.digest"),
+	}
+	a.digests.clock = clk
+	a.digests.emit = a.emitDigest
+	ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+	// rejected by the flaky sink and redelivered by the broker
+	event := keyedEvent(t, 1, clusterChanged("alarm-1", "host-1", "cluster-1", "red"))
+	_, result := a.handleEvent(ctx, event)
+	assert.Assert(t, result != nil)
+	_, result = a.handleEvent(ctx, event)
+	assert.NilError(t, result)
+
+	clk.Add(time.Minute)
+	events := sink.get()
+	assert.Equal(t, len(events), 3, "two individual events and the digest")
+
+	var data alarmDigest
+	assert.NilError(t, events[2].DataAs(&data))
+	assert.Equal(t, data.Events, 1)
+}
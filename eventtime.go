@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/vmware/govmomi/vim25/types"
+	"knative.dev/pkg/logging"
+)
+
+// processedTimeExtension is the CloudEvents extension attribute holding the
+// time the server processed the event
+const processedTimeExtension = "processedtime"
+
+// eventTimeMode selects the time attribute of returned events
+type eventTimeMode string
+
+const (
+	timeNow      eventTimeMode = "now"      // processing time (set by the client)
+	timeCreated  eventTimeMode = "created"  // CreatedTime of the vSphere event
+	timeOriginal eventTimeMode = "original" // time of the received event
+)
+
+func parseEventTimeMode(s string) (eventTimeMode, error) {
+	switch m := eventTimeMode(strings.ToLower(s)); m {
+	case "", timeNow:
+		return timeNow, nil
+	case timeCreated, timeOriginal:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid event time %q: must be one of %s, %s, %s", s, timeNow, timeCreated, timeOriginal)
+	}
+}
+
+// eventTime returns the time attribute of the response to the specified event.
+// A zero time is returned if the processing time should be used or the
+// selected time is not available.
+func (a *alarmServer) eventTime(event cloudevents.Event) time.Time {
+	switch a.timeMode {
+	case timeOriginal:
+		return event.Time()
+	case timeCreated:
+		// all vSphere events embed the base event
+		var e types.Event
+		if err := event.DataAs(&e); err != nil {
+			return time.Time{}
+		}
+		return e.CreatedTime
+	default:
+		return time.Time{}
+	}
+}
+
+// checkSkew logs a warning if the creation time of the vSphere event diverges
+// from the server time by more than the skew threshold which indicates that
+// the clocks of vCenter and the server are not synchronized. Delivery delays,
+// e.g. when replaying a backlog, are also reported.
+func (a *alarmServer) checkSkew(ctx context.Context, created time.Time) {
+	if a.skewThreshold == 0 || created.IsZero() {
+		return
+	}
+
+	skew := a.now().Sub(created)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > a.skewThreshold {
+		logging.FromContext(ctx).Warnw("vsphere event time diverges from server time", "created", created.UTC(), "server", a.now().UTC(), "skew", skew.String(), "threshold", a.skewThreshold.String())
+	}
+}
+
+// now returns the current time of the server clock
+func (a *alarmServer) now() time.Time {
+	if a.clock == nil {
+		return time.Now()
+	}
+	return a.clock.Now()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/types"
+	vim "github.com/vmware/govmomi/vim25/types"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func Test_alarmServer_newResponse_time(t *testing.T) {
+	var (
+		created   = time.Date(2021, 4, 10, 20, 49, 30, 0, time.UTC)
+		received  = time.Date(2021, 4, 10, 20, 49, 31, 0, time.UTC)
+		processed = time.Date(2021, 4, 10, 21, 0, 0, 0, time.UTC)
+	)
+
+	data, err := json.Marshal(vim.AlarmStatusChangedEvent{
+		AlarmEvent: vim.AlarmEvent{Event: vim.Event{Key: 1, CreatedTime: created}},
+	})
+	assert.NilError(t, err)
+
+	event := cloudevents.NewEvent()
+	event.SetID("1")
+	event.SetSource(vc)
+	event.SetType("AlarmStatusChangedEvent")
+	event.SetTime(received)
+	err = event.SetData(cloudevents.ApplicationJSON, data)
+	assert.NilError(t, err)
+
+	noTime := event.Clone()
+	noTime.Context.(*cloudevents.EventContextV1).Time = nil
+
+	tests := []struct {
+		name          string
+		mode          eventTimeMode
+		processedTime bool
+		event         cloudevents.Event
+		wantTime      time.Time // zero if set by the client
+	}{
+		{
+			name:     "processing time",
+			mode:     timeNow,
+			event:    event,
+			wantTime: time.Time{},
+		},
+		{
+			name:     "vsphere event created time",
+			mode:     timeCreated,
+			event:    event,
+			wantTime: created,
+		},
+		{
+			name:     "original event time",
+			mode:     timeOriginal,
+			event:    event,
+			wantTime: received,
+		},
+		{
+			name:     "original event without time",
+			mode:     timeOriginal,
+			event:    noTime,
+			wantTime: time.Time{},
+		},
+		{
+			name:          "processed time extension",
+			mode:          timeCreated,
+			processedTime: true,
+			event:         event,
+			wantTime:      created,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := clock.NewMock()
+			mock.Set(processed)
+
+			a := &alarmServer{
+				source:        vc,
+				clock:         mock,
+				timeMode:      tt.mode,
+				processedTime: tt.processedTime,
+			}
+
+			resp, err := a.newResponse(context.Background(), tt.event, "AlarmStatusChangedEvent."+suffix, tt.event.Data())
+			assert.NilError(t, err)
+			assert.Assert(t, resp.Time().Equal(tt.wantTime), "time: %v", resp.Time())
+
+			ext, ok := resp.Extensions()[processedTimeExtension]
+			assert.Equal(t, ok, tt.processedTime)
+			if tt.processedTime {
+				got, err := types.ToTime(ext)
+				assert.NilError(t, err)
+				assert.Assert(t, got.Equal(processed), "processedtime: %v", got)
+			}
+		})
+	}
+}
+
+func Test_alarmServer_checkSkew(t *testing.T) {
+	now := time.Date(2021, 4, 10, 21, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		created   time.Time
+		wantWarn  bool
+	}{
+		{
+			name:      "within threshold",
+			threshold: time.Minute,
+			created:   now.Add(-time.Second * 30),
+			wantWarn:  false,
+		},
+		{
+			name:      "vcenter clock behind",
+			threshold: time.Minute,
+			created:   now.Add(-time.Minute * 2),
+			wantWarn:  true,
+		},
+		{
+			name:      "vcenter clock ahead",
+			threshold: time.Minute,
+			created:   now.Add(time.Minute * 2),
+			wantWarn:  true,
+		},
+		{
+			name:      "disabled",
+			threshold: 0,
+			created:   now.Add(time.Hour),
+			wantWarn:  false,
+		},
+		{
+			name:      "no created time",
+			threshold: time.Minute,
+			created:   time.Time{},
+			wantWarn:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&buf), zap.DebugLevel)
+			ctx := logging.WithLogger(context.Background(), zap.New(core).Sugar())
+
+			mock := clock.NewMock()
+			mock.Set(now)
+			a := &alarmServer{clock: mock, skewThreshold: tt.threshold}
+
+			a.checkSkew(ctx, tt.created)
+			assert.Equal(t, bytes.Contains(buf.Bytes(), []byte("diverges from server time")), tt.wantWarn, "log: %s", buf.String())
+		})
+	}
+}
+
+func Test_parseEventTimeMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		want    eventTimeMode
+		wantErr bool
+	}{
+		{mode: "", want: timeNow},
+		{mode: "now", want: timeNow},
+		{mode: "Created", want: timeCreated},
+		{mode: "original", want: timeOriginal},
+		{mode: "received", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			got, err := parseEventTimeMode(tt.mode)
+			assert.Equal(t, err != nil, tt.wantErr, "error: %v", err)
+			assert.Equal(t, got, tt.want)
+		})
+	}
+}
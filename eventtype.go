@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// typeMode selects how the type of returned events is derived
+type typeMode string
+
+const (
+	// typeSuffix appends the event suffix to the received type (default)
+	typeSuffix typeMode = "suffix"
+	// typeTransition derives the type from the alarm event class and the
+	// status transition, e.g. <prefix>.alarm.raised
+	typeTransition typeMode = "transition"
+)
+
+// typeMapping maps an alarm event class and status transition to a type
+// name. Empty statuses match any status.
+type typeMapping struct {
+	Event string   `yaml:"event"`
+	From  []string `yaml:"from"`
+	To    []string `yaml:"to"`
+	Type  string   `yaml:"type"`
+}
+
+// defaultTypeMappings are used if no mapping file is configured
+var defaultTypeMappings = []typeMapping{
+	{Event: "AlarmStatusChangedEvent", To: []string{"green"}, Type: "resolved"},
+	{Event: "AlarmStatusChangedEvent", From: []string{"green", "gray"}, To: []string{"yellow", "red"}, Type: "raised"},
+	{Event: "AlarmStatusChangedEvent", From: []string{"yellow"}, To: []string{"red"}, Type: "escalated"},
+	{Event: "AlarmStatusChangedEvent", From: []string{"red"}, To: []string{"yellow"}, Type: "deescalated"},
+	{Event: "AlarmAcknowledgedEvent", Type: "acknowledged"},
+	{Event: "AlarmClearedEvent", Type: "resolved"},
+}
+
+// typeMapper derives the type of returned events from the alarm transition
+// using the first matching mapping. A nil mapper does not map.
+type typeMapper struct {
+	prefix   string
+	mappings []typeMapping
+}
+
+// newTypeMapper returns the mapper for the specified mode. The mappings are
+// read from the specified file, if any, otherwise the default mappings are
+// used. The suffix mode returns a nil mapper.
+func newTypeMapper(mode typeMode, prefix, file string) (*typeMapper, error) {
+	switch mode {
+	case typeSuffix, "":
+		return nil, nil
+	case typeTransition:
+	default:
+		return nil, fmt.Errorf("invalid EVENT_TYPE_MODE %q: must be %q or %q", mode, typeSuffix, typeTransition)
+	}
+
+	if prefix == "" {
+		return nil, fmt.Errorf("EVENT_TYPE_PREFIX must not be empty")
+	}
+
+	mappings := defaultTypeMappings
+	if file != "" {
+		var err error
+		if mappings, err = loadTypeMappings(file); err != nil {
+			return nil, err
+		}
+	}
+	return &typeMapper{prefix: prefix, mappings: mappings}, nil
+}
+
+func loadTypeMappings(path string) ([]typeMapping, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read type mapping file: %w", err)
+	}
+
+	var cfg struct {
+		Mappings []typeMapping `yaml:"mappings"`
+	}
+	if err = yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("decode type mapping file: %w", err)
+	}
+
+	for i, m := range cfg.Mappings {
+		if m.Event == "" || m.Type == "" {
+			return nil, fmt.Errorf("type mapping %d: event and type must not be empty", i+1)
+		}
+	}
+	return cfg.Mappings, nil
+}
+
+// typeOf returns the mapped type of the alarm event, false if no mapping
+// matches. The event class is taken from the subject or type of the received
+// event, e.g. subject AlarmStatusChangedEvent or type
+// com.vmware.vsphere.AlarmStatusChangedEvent.v0.
+func (m *typeMapper) typeOf(event cloudevents.Event) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+
+	var transition struct {
+		From string
+		To   string
+	}
+	// events without transition, e.g. AlarmAcknowledgedEvent, match mappings
+	// without statuses only
+	_ = event.DataAs(&transition)
+
+	tokens := strings.FieldsFunc(event.Subject()+" "+event.Type(), func(r rune) bool {
+		return r == '.' || r == '/' || r == ' '
+	})
+
+	for _, mapping := range m.mappings {
+		if !containsString(tokens, mapping.Event) {
+			continue
+		}
+		if matchStatus(mapping.From, transition.From) && matchStatus(mapping.To, transition.To) {
+			return m.prefix + ".alarm." + mapping.Type, true
+		}
+	}
+	return "", false
+}
+
+// own returns true if the type was produced by the mapper
+func (m *typeMapper) own(eventType string) bool {
+	return m != nil && strings.HasPrefix(eventType, m.prefix+".alarm.")
+}
+
+func matchStatus(statuses []string, status string) bool {
+	if len(statuses) == 0 {
+		return true
+	}
+	for _, s := range statuses {
+		if strings.EqualFold(s, status) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// responseType returns the type of the returned event for the received event,
+// the mapped type or the received type with the event suffix
+func (a *alarmServer) responseType(event cloudevents.Event) string {
+	if t, ok := a.types.typeOf(event); ok {
+		return t
+	}
+	return event.Type() + a.suffix
+}
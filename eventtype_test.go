@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func alarmTransitionEvent(t *testing.T, eventType, subject, from, to string) cloudevents.Event {
+	t.Helper()
+
+	event := cloudevents.NewEvent()
+	event.SetSource(vc)
+	event.SetType(eventType)
+	event.SetSubject(subject)
+	err := event.SetData(cloudevents.ApplicationJSON, map[string]interface{}{
+		"Alarm": map[string]interface{}{"Alarm": map[string]string{"Type": "Alarm", "Value": "alarm-1"}},
+		"From":  from,
+		"To":    to,
+	})
+	assert.NilError(t, err)
+	return event
+}
+
+func Test_newTypeMapper(t *testing.T) {
+	m, err := newTypeMapper(typeSuffix, "com.vmware.vsphere", "")
+	assert.NilError(t, err)
+	assert.Assert(t, m == nil)
+
+	m, err = newTypeMapper(typeTransition, "com.vmware.vsphere", "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(m.mappings), len(defaultTypeMappings))
+
+	_, err = newTypeMapper("class", "com.vmware.vsphere", "")
+	assert.ErrorContains(t, err, `invalid EVENT_TYPE_MODE "class"`)
+
+	_, err = newTypeMapper(typeTransition, "", "")
+	assert.ErrorContains(t, err, "EVENT_TYPE_PREFIX must not be empty")
+
+	path := filepath.Join(t.TempDir(), "mappings.yaml")
+	err = os.WriteFile(path, []byte("mappings:\n  - event: AlarmStatusChangedEvent\n    to: [red]\n"), 0644)
+	assert.NilError(t, err)
+	_, err = newTypeMapper(typeTransition, "com.vmware.vsphere", path)
+	assert.ErrorContains(t, err, "type mapping 1: event and type must not be empty")
+
+	err = os.WriteFile(path, []byte("mappings:\n  - event: AlarmStatusChangedEvent\n    status: red\n    type: critical\n"), 0644)
+	assert.NilError(t, err)
+	_, err = newTypeMapper(typeTransition, "com.vmware.vsphere", path)
+	assert.ErrorContains(t, err, "decode type mapping file")
+}
+
+func Test_typeMapper_typeOf(t *testing.T) {
+	m, err := newTypeMapper(typeTransition, "com.vmware.vsphere", "")
+	assert.NilError(t, err)
+
+	tests := []struct {
+		name      string
+		eventType string
+		subject   string
+		from      string
+		to        string
+		want      string // empty if not mapped
+	}{
+		{name: "raised", eventType: "AlarmStatusChangedEvent", from: "green", to: "yellow", want: "com.vmware.vsphere.alarm.raised"},
+		{name: "raised from gray", eventType: "AlarmStatusChangedEvent", from: "gray", to: "red", want: "com.vmware.vsphere.alarm.raised"},
+		{name: "escalated", eventType: "AlarmStatusChangedEvent", from: "yellow", to: "red", want: "com.vmware.vsphere.alarm.escalated"},
+		{name: "deescalated", eventType: "AlarmStatusChangedEvent", from: "red", to: "yellow", want: "com.vmware.vsphere.alarm.deescalated"},
+		{name: "resolved", eventType: "AlarmStatusChangedEvent", from: "red", to: "green", want: "com.vmware.vsphere.alarm.resolved"},
+		{name: "versioned type", eventType: "com.vmware.vsphere.AlarmStatusChangedEvent.v0", from: "green", to: "red", want: "com.vmware.vsphere.alarm.raised"},
+		{name: "class from subject", eventType: "com.vmware.event.router/event", subject: "AlarmStatusChangedEvent", from: "yellow", to: "green", want: "com.vmware.vsphere.alarm.resolved"},
+		{name: "acknowledged", eventType: "AlarmAcknowledgedEvent", want: "com.vmware.vsphere.alarm.acknowledged"},
+		{name: "cleared", eventType: "AlarmClearedEvent", from: "red", want: "com.vmware.vsphere.alarm.resolved"},
+		{name: "unmapped transition", eventType: "AlarmStatusChangedEvent", from: "green", to: "gray"},
+		{name: "unmapped class", eventType: "AlarmCreatedEvent"},
+		{name: "partial class name", eventType: "MyAlarmClearedEvent"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := m.typeOf(alarmTransitionEvent(t, tt.eventType, tt.subject, tt.from, tt.to))
+			assert.Equal(t, got, tt.want)
+			assert.Equal(t, ok, tt.want != "")
+		})
+	}
+}
+
+func Test_alarmServer_handleEvent_transitionTypes(t *testing.T) {
+	m, err := newTypeMapper(typeTransition, "com.vmware.vsphere", "")
+	assert.NilError(t, err)
+
+	c := newAlarmCache(3600)
+	c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+
+	a := &alarmServer{
+		session:   newSession(nil, ""),
+		cache:     c,
+		clock:     clock.NewMock(),
+		source:    vc,
+		suffix:    "." + suffix,
+		types:     m,
+		injectKey: injectKey,
+		metrics:   newMetrics(),
+	}
+	ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+	resp, result := a.handleEvent(ctx, alarmTransitionEvent(t, "AlarmStatusChangedEvent", "", "yellow", "red"))
+	assert.NilError(t, result)
+	assert.Equal(t, resp.Type(), "com.vmware.vsphere.alarm.escalated")
+
+	// unmapped events keep the suffix
+	resp, result = a.handleEvent(ctx, alarmTransitionEvent(t, "AlarmStatusChangedEvent", "", "green", "gray"))
+	assert.NilError(t, result)
+	assert.Equal(t, resp.Type(), "AlarmStatusChangedEvent."+suffix)
+
+	// returned events are not enriched again
+	own := alarmTransitionEvent(t, "com.vmware.vsphere.alarm.raised", "", "green", "red")
+	resp, result = a.handleEvent(ctx, own)
+	assert.NilError(t, result)
+	assert.Assert(t, resp == nil)
+	assert.Equal(t, a.metrics.events.get(outcomeIgnored, reasonSelf), float64(1))
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/vmware/govmomi/vim25/types"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	alarmsPath = "/alarms"
+
+	// flapMaxTransitions bounds the transition history of a single alarm and
+	// entity
+	flapMaxTransitions = 100
+
+	// keys of the flapping information in the enriched payload
+	flappingKey    = "flapping"
+	transitionsKey = "transitions"
+)
+
+// transition is a status change of an alarm on an entity
+type transition struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+// alarmHistory holds the recent transitions of an alarm on an entity
+type alarmHistory struct {
+	alarm       string // moref
+	entity      string // moref
+	entityName  string
+	transitions []transition // oldest first
+	flapping    bool
+}
+
+// alarmStats is the admin representation of an alarm history
+type alarmStats struct {
+	Alarm       string       `json:"alarm"`
+	Entity      string       `json:"entity"`
+	EntityName  string       `json:"entityName,omitempty"`
+	Status      string       `json:"status"`            // current status
+	Transitions int          `json:"transitions"`       // within the window
+	Flapping    bool         `json:"flapping"`          // transitions crossed the threshold
+	History     []transition `json:"history,omitempty"` // within the window, most recent first
+}
+
+// flapTracker tracks the status transitions of alarms per entity over a
+// sliding window to detect flapping alarms. An alarm is flapping while the
+// number of transitions within the window is at or above the threshold. The
+// number of tracked alarms is bounded, the least recently changed alarm is
+// evicted when full. A nil tracker does not track.
+type flapTracker struct {
+	clock     clock.Clock
+	window    time.Duration
+	threshold int
+	size      int // max tracked alarm and entity pairs
+
+	sync.Mutex
+	entries map[string]*alarmHistory // keyed by alarm and entity moref
+}
+
+func newFlapTracker(window time.Duration, threshold, size int) *flapTracker {
+	return &flapTracker{
+		clock:     clock.New(),
+		window:    window,
+		threshold: threshold,
+		size:      size,
+		entries:   map[string]*alarmHistory{},
+	}
+}
+
+// record records the transition of the alarm status event and returns the
+// number of transitions within the window and whether the alarm is flapping.
+// Events without a status change are not recorded.
+func (f *flapTracker) record(ctx context.Context, event types.AlarmStatusChangedEvent) (int, bool) {
+	if f == nil || event.To == "" || event.From == event.To {
+		return 0, false
+	}
+
+	alarm, entity := event.Alarm.Alarm.String(), event.Entity.Entity.String()
+	key := alarm + "/" + entity
+	now := f.clock.Now().UTC()
+
+	f.Lock()
+	defer f.Unlock()
+
+	h, ok := f.entries[key]
+	if !ok {
+		if len(f.entries) >= f.size {
+			f.evict()
+		}
+		h = &alarmHistory{alarm: alarm, entity: entity}
+		f.entries[key] = h
+	}
+	h.entityName = event.Entity.Name
+
+	h.transitions = append(h.transitions, transition{From: event.From, To: event.To, At: now})
+	if len(h.transitions) > flapMaxTransitions {
+		h.transitions = h.transitions[len(h.transitions)-flapMaxTransitions:]
+	}
+
+	n := f.prune(h, now)
+	flapping := n >= f.threshold
+	if flapping != h.flapping {
+		logger := logging.FromContext(ctx).With("alarm", alarm, "entity", entity, "transitions", n, "window", f.window.String())
+		if flapping {
+			logger.Warn("alarm started flapping")
+		} else {
+			logger.Info("alarm stopped flapping")
+		}
+	}
+	h.flapping = flapping
+	return n, flapping
+}
+
+// prune removes the transitions of the history outside the window except
+// the last one to keep the current status and returns the number of
+// transitions within the window. The lock must be held.
+func (f *flapTracker) prune(h *alarmHistory, now time.Time) int {
+	i := sort.Search(len(h.transitions), func(i int) bool {
+		return now.Sub(h.transitions[i].At) < f.window
+	})
+	if i == len(h.transitions) {
+		h.transitions = h.transitions[i-1:]
+		return 0
+	}
+	h.transitions = h.transitions[i:]
+	return len(h.transitions)
+}
+
+// evict removes the least recently changed history. The lock must be held.
+func (f *flapTracker) evict() {
+	var (
+		oldest string
+		at     time.Time
+	)
+	for k, h := range f.entries {
+		last := h.transitions[len(h.transitions)-1].At
+		if oldest == "" || last.Before(at) {
+			oldest, at = k, last
+		}
+	}
+	delete(f.entries, oldest)
+}
+
+// stats returns the statistics of all tracked alarms ordered by the number of
+// transitions, highest first
+func (f *flapTracker) stats() []alarmStats {
+	stats := []alarmStats{}
+	if f == nil {
+		return stats
+	}
+
+	now := f.clock.Now().UTC()
+
+	f.Lock()
+	defer f.Unlock()
+	for _, h := range f.entries {
+		n := f.prune(h, now)
+		h.flapping = n >= f.threshold
+
+		var history []transition
+		for i := len(h.transitions) - 1; i >= len(h.transitions)-n; i-- {
+			history = append(history, h.transitions[i])
+		}
+
+		stats = append(stats, alarmStats{
+			Alarm:       h.alarm,
+			Entity:      h.entity,
+			EntityName:  h.entityName,
+			Status:      h.transitions[len(h.transitions)-1].To,
+			Transitions: n,
+			Flapping:    h.flapping,
+			History:     history,
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Transitions != stats[j].Transitions {
+			return stats[i].Transitions > stats[j].Transitions
+		}
+		return stats[i].Alarm+stats[i].Entity < stats[j].Alarm+stats[j].Entity
+	})
+	return stats
+}
+
+// countFlapping returns the number of flapping alarms of the statistics
+func countFlapping(stats []alarmStats) int {
+	n := 0
+	for _, s := range stats {
+		if s.Flapping {
+			n++
+		}
+	}
+	return n
+}
+
+// injectFlapping adds the flapping information to the JSON-encoded data
+func injectFlapping(data []byte, transitions int) ([]byte, error) {
+	patchJSON := fmt.Sprintf(`[{"op":"add","path":"/%s","value":true},{"op":"add","path":"/%s","value":%d}]`, flappingKey, transitionsKey, transitions)
+	patch, err := jsonpatch.DecodePatch([]byte(patchJSON))
+	if err != nil {
+		return nil, fmt.Errorf("decode JSON patch: %w", err)
+	}
+
+	patched, err := patch.Apply(data)
+	if err != nil {
+		return nil, fmt.Errorf("apply JSON patch: %w", err)
+	}
+	return patched, nil
+}
+
+// recordTransition records the status transition of an alarm status event and
+// returns the number of transitions within the flap window and whether the
+// alarm is flapping
+func (a *alarmServer) recordTransition(ctx context.Context, event cloudevents.Event) (int, bool) {
+	if a.flaps == nil {
+		return 0, false
+	}
+
+	// other alarm events do not change the status
+	var changed types.AlarmStatusChangedEvent
+	if err := event.DataAs(&changed); err != nil || changed.To == "" || changed.From == changed.To {
+		return 0, false
+	}
+
+	a.metrics.transition(changed.Alarm.Alarm.Value)
+	n, flapping := a.flaps.record(ctx, changed)
+	decisionFrom(ctx).step("record transition %s -> %s: transitions=%d flapping=%t", changed.From, changed.To, n, flapping)
+	return n, flapping
+}
+
+// handleAlarms returns the transition statistics of the tracked alarms,
+// optionally only flapping alarms (flapping=true)
+func (a *alarmServer) handleAlarms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	var onlyFlapping bool
+	if v := r.URL.Query().Get("flapping"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid flapping %q", v))
+			return
+		}
+		onlyFlapping = b
+	}
+
+	stats := []alarmStats{}
+	for _, s := range a.flaps.stats() {
+		if onlyFlapping && !s.Flapping {
+			continue
+		}
+		stats = append(stats, s)
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func statusChanged(alarm, entity, from, to string) types.AlarmStatusChangedEvent {
+	return types.AlarmStatusChangedEvent{
+		AlarmEvent: types.AlarmEvent{
+			Alarm: types.AlarmEventArgument{
+				Alarm: types.ManagedObjectReference{Type: "Alarm", Value: alarm},
+			},
+		},
+		Entity: types.ManagedEntityEventArgument{
+			EntityEventArgument: types.EntityEventArgument{Name: entity},
+			Entity:              types.ManagedObjectReference{Type: "HostSystem", Value: entity},
+		},
+		From: from,
+		To:   to,
+	}
+}
+
+func Test_flapTracker_record(t *testing.T) {
+	type step struct {
+		wait         time.Duration // before recording
+		event        types.AlarmStatusChangedEvent
+		wantN        int
+		wantFlapping bool
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "flapping at threshold",
+			steps: []step{
+				{event: statusChanged("alarm-1", "host-1", "green", "red"), wantN: 1},
+				{wait: time.Minute, event: statusChanged("alarm-1", "host-1", "red", "green"), wantN: 2},
+				{wait: time.Minute, event: statusChanged("alarm-1", "host-1", "green", "red"), wantN: 3, wantFlapping: true},
+			},
+		},
+		{
+			name: "transitions per entity",
+			steps: []step{
+				{event: statusChanged("alarm-1", "host-1", "green", "red"), wantN: 1},
+				{event: statusChanged("alarm-1", "host-2", "green", "red"), wantN: 1},
+				{event: statusChanged("alarm-2", "host-1", "green", "red"), wantN: 1},
+				{event: statusChanged("alarm-1", "host-1", "red", "green"), wantN: 2},
+			},
+		},
+		{
+			name: "transitions outside the window are not counted",
+			steps: []step{
+				{event: statusChanged("alarm-1", "host-1", "green", "red"), wantN: 1},
+				{wait: time.Minute * 30, event: statusChanged("alarm-1", "host-1", "red", "green"), wantN: 2},
+				{wait: time.Minute * 20, event: statusChanged("alarm-1", "host-1", "green", "red"), wantN: 3, wantFlapping: true},
+				{wait: time.Minute * 15, event: statusChanged("alarm-1", "host-1", "red", "green"), wantN: 3, wantFlapping: true},
+				{wait: time.Minute * 50, event: statusChanged("alarm-1", "host-1", "green", "red"), wantN: 2},
+			},
+		},
+		{
+			name: "events without status change are not recorded",
+			steps: []step{
+				{event: statusChanged("alarm-1", "host-1", "green", "red"), wantN: 1},
+				{event: statusChanged("alarm-1", "host-1", "red", "red"), wantN: 0},
+				{event: statusChanged("alarm-1", "host-1", "", ""), wantN: 0},
+				{event: statusChanged("alarm-1", "host-1", "red", "green"), wantN: 2},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := clock.NewMock()
+			f := newFlapTracker(time.Hour, 3, 10)
+			f.clock = mock
+			ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+			for i, s := range tt.steps {
+				mock.Add(s.wait)
+				n, flapping := f.record(ctx, s.event)
+				assert.Equal(t, n, s.wantN, "step %d", i)
+				assert.Equal(t, flapping, s.wantFlapping, "step %d", i)
+			}
+		})
+	}
+}
+
+func Test_flapTracker_stats(t *testing.T) {
+	mock := clock.NewMock()
+	f := newFlapTracker(time.Hour, 2, 2)
+	f.clock = mock
+	ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+	f.record(ctx, statusChanged("alarm-1", "host-1", "green", "red"))
+	mock.Add(time.Minute)
+	f.record(ctx, statusChanged("alarm-2", "host-1", "green", "red"))
+	mock.Add(time.Minute)
+	f.record(ctx, statusChanged("alarm-2", "host-1", "red", "green"))
+
+	stats := f.stats()
+	assert.Equal(t, len(stats), 2)
+	assert.Equal(t, stats[0].Alarm, "Alarm:alarm-2")
+	assert.Equal(t, stats[0].Status, "green")
+	assert.Equal(t, stats[0].Transitions, 2)
+	assert.Equal(t, stats[0].Flapping, true)
+	assert.Equal(t, stats[0].History[0].To, "green") // most recent first
+	assert.Equal(t, stats[1].Alarm, "Alarm:alarm-1")
+	assert.Equal(t, countFlapping(f.stats()), 1)
+
+	// least recently changed alarm is evicted when full
+	mock.Add(time.Minute)
+	f.record(ctx, statusChanged("alarm-3", "host-1", "green", "yellow"))
+	stats = f.stats()
+	assert.Equal(t, len(stats), 2)
+	assert.Equal(t, stats[0].Alarm, "Alarm:alarm-2")
+	assert.Equal(t, stats[1].Alarm, "Alarm:alarm-3")
+
+	// current status is kept after the window
+	mock.Add(time.Hour * 2)
+	stats = f.stats()
+	assert.Equal(t, len(stats), 2)
+	assert.Equal(t, stats[0].Transitions, 0)
+	assert.Equal(t, stats[0].Status, "green")
+	assert.Equal(t, len(stats[0].History), 0)
+	assert.Equal(t, countFlapping(f.stats()), 0)
+}
+
+func Test_alarmServer_handleEvent_flapping(t *testing.T) {
+	testEvents := createCloudEvents(t)
+
+	c := newAlarmCache(3600)
+	c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+
+	a := &alarmServer{
+		session:   newSession(nil, ""),
+		cache:     c,
+		clock:     clock.NewMock(),
+		source:    vc,
+		suffix:    "." + suffix,
+		injectKey: injectKey,
+		metrics:   newMetrics(),
+		flaps:     newFlapTracker(time.Hour, 2, 10),
+	}
+	ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+	payload := func(resp *cloudevents.Event) map[string]interface{} {
+		var data map[string]interface{}
+		assert.NilError(t, json.Unmarshal(resp.Data(), &data))
+		return data
+	}
+
+	resp, result := a.handleEvent(ctx, *testEvents["AlarmStatusChangedEvent"])
+	assert.NilError(t, result)
+	_, ok := payload(resp)[flappingKey]
+	assert.Assert(t, !ok)
+
+	resp, result = a.handleEvent(ctx, *testEvents["AlarmStatusChangedEvent"])
+	assert.NilError(t, result)
+	data := payload(resp)
+	assert.Equal(t, data[flappingKey], true)
+	assert.Equal(t, data[transitionsKey], float64(2))
+	assert.Assert(t, data[injectKey] != nil)
+	assert.Equal(t, a.metrics.transitions.get("alarm-1"), float64(2))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/alarms?flapping=true", nil)
+	a.adminHandler(ctx).ServeHTTP(rec, req)
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	var stats []alarmStats
+	assert.NilError(t, json.NewDecoder(rec.Body).Decode(&stats))
+	assert.Equal(t, len(stats), 1)
+	assert.Equal(t, stats[0].Alarm, "Alarm:alarm-1")
+	assert.Equal(t, stats[0].Transitions, 2)
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/alarms?flapping=maybe", nil)
+	a.adminHandler(ctx).ServeHTTP(rec, req)
+	assert.Equal(t, rec.Code, http.StatusBadRequest)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+const (
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+
+	sessionCheckInterval = time.Second * 10 // min interval between vCenter session checks
+	sessionCheckTimeout  = time.Second * 5
+	cacheGCStallFactor   = 3 // GC intervals without a GC run before the loop is considered stalled
+)
+
+var (
+	errReceiverStopped  = errors.New("event receiver not running")
+	errNotAuthenticated = errors.New("vcenter session not authenticated")
+)
+
+// healthCheck is the admin representation of a single health check
+type healthCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// healthStatus is the admin representation of the health of the server
+type healthStatus struct {
+	Status string                 `json:"status"` // ok or failed
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// sessionProbe checks whether the vCenter session is authenticated. Results
+// are cached for the probe interval so that frequent probes do not put load on
+// vCenter. A nil probe checks on every call.
+type sessionProbe struct {
+	clock    clock.Clock
+	interval time.Duration
+
+	sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func newSessionProbe(interval time.Duration) *sessionProbe {
+	return &sessionProbe{
+		clock:    clock.New(),
+		interval: interval,
+	}
+}
+
+// check returns the cached result of the last check if it is more recent than
+// the probe interval, otherwise it checks the current session of the client
+func (p *sessionProbe) check(ctx context.Context, s *session) error {
+	if p == nil {
+		return checkSession(ctx, s)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	now := p.clock.Now()
+	if !p.checked.IsZero() && now.Sub(p.checked) < p.interval {
+		return p.err
+	}
+
+	p.err = checkSession(ctx, s)
+	p.checked = now
+	return p.err
+}
+
+func checkSession(ctx context.Context, s *session) error {
+	vc := s.client()
+	if vc == nil {
+		return errNotConnected
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sessionCheckTimeout)
+	defer cancel()
+
+	us, err := vc.SessionManager.UserSession(ctx)
+	if err != nil {
+		return fmt.Errorf("retrieve current session: %w", err)
+	}
+	if us == nil {
+		return errNotAuthenticated
+	}
+	return nil
+}
+
+// receiverCheck returns an error if the CloudEvents receiver is not running
+func (a *alarmServer) receiverCheck() error {
+	if atomic.LoadInt32(&a.receiving) == 0 {
+		return errReceiverStopped
+	}
+	return nil
+}
+
+// runHealth starts the health HTTP server serving the liveness and readiness
+// probes and blocks until the context is cancelled. It is separate from the
+// admin server so that the probes are always available.
+func (a *alarmServer) runHealth(ctx context.Context) error {
+	if err := serveHTTP(ctx, "", a.healthPort, a.healthHandler()); err != nil {
+		return fmt.Errorf("run health server: %w", err)
+	}
+	return nil
+}
+
+// healthHandler returns the HTTP handler serving the probes
+func (a *alarmServer) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthPath, a.handleHealth)
+	mux.HandleFunc(readyPath, a.handleReady)
+	return mux
+}
+
+// handleHealth reports whether the server is alive, i.e. the event receiver
+// and the cache GC loop are running. vCenter is not checked so that the server
+// is not restarted while vCenter is unavailable.
+func (a *alarmServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	writeHealth(w, map[string]error{
+		"receiver": a.receiverCheck(),
+		"cache":    a.cache.gcCheck(),
+	})
+}
+
+// handleReady reports whether the server is ready to enrich events, i.e. it is
+// alive and the vCenter session is authenticated, so that Kubernetes does not
+// route events to a server which cannot enrich them
+func (a *alarmServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	writeHealth(w, map[string]error{
+		"receiver": a.receiverCheck(),
+		"cache":    a.cache.gcCheck(),
+		"vcenter":  a.probe.check(r.Context(), a.session),
+	})
+}
+
+// writeHealth writes the result of the specified checks with 200 if all
+// checks passed and 503 otherwise
+func writeHealth(w http.ResponseWriter, checks map[string]error) {
+	status := healthStatus{
+		Status: "ok",
+		Checks: make(map[string]healthCheck, len(checks)),
+	}
+
+	for name, err := range checks {
+		if err != nil {
+			status.Status = "failed"
+			status.Checks[name] = healthCheck{Error: err.Error()}
+			continue
+		}
+		status.Checks[name] = healthCheck{OK: true}
+	}
+
+	if status.Status != "ok" {
+		writeJSON(w, http.StatusServiceUnavailable, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
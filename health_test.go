@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func Test_alarmServer_health(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string
+		receiving bool
+		gc        bool // cache gc loop running
+		connected bool
+		logout    bool
+		wantCode  int
+		wantOK    map[string]bool
+	}{
+		{
+			name:      "alive",
+			path:      "/healthz",
+			receiving: true,
+			gc:        true,
+			wantCode:  http.StatusOK,
+			wantOK:    map[string]bool{"receiver": true, "cache": true},
+		},
+		{
+			name:      "receiver stopped",
+			path:      "/healthz",
+			receiving: false,
+			gc:        true,
+			wantCode:  http.StatusServiceUnavailable,
+			wantOK:    map[string]bool{"receiver": false, "cache": true},
+		},
+		{
+			name:      "alive while vcenter unavailable",
+			path:      "/healthz",
+			receiving: true,
+			gc:        true,
+			connected: false,
+			wantCode:  http.StatusOK,
+			wantOK:    map[string]bool{"receiver": true, "cache": true},
+		},
+		{
+			name:      "ready",
+			path:      "/readyz",
+			receiving: true,
+			gc:        true,
+			connected: true,
+			wantCode:  http.StatusOK,
+			wantOK:    map[string]bool{"receiver": true, "cache": true, "vcenter": true},
+		},
+		{
+			name:      "not ready before connected",
+			path:      "/readyz",
+			receiving: true,
+			gc:        true,
+			connected: false,
+			wantCode:  http.StatusServiceUnavailable,
+			wantOK:    map[string]bool{"receiver": true, "cache": true, "vcenter": false},
+		},
+		{
+			name:      "not ready without session",
+			path:      "/readyz",
+			receiving: true,
+			gc:        true,
+			connected: true,
+			logout:    true,
+			wantCode:  http.StatusServiceUnavailable,
+			wantOK:    map[string]bool{"receiver": true, "cache": true, "vcenter": false},
+		},
+		{
+			name:      "not ready with cache gc loop stopped",
+			path:      "/readyz",
+			receiving: true,
+			gc:        false,
+			connected: true,
+			wantCode:  http.StatusServiceUnavailable,
+			wantOK:    map[string]bool{"receiver": true, "cache": false, "vcenter": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			simulator.Test(func(ctx context.Context, client *vim25.Client) {
+				ctx = logging.WithLogger(ctx, zaptest.NewLogger(t).Sugar())
+
+				var vc *govmomi.Client
+				if tt.connected {
+					vc = simulatorClient(t, client)
+				}
+				if tt.logout {
+					err := vc.SessionManager.Logout(ctx)
+					assert.NilError(t, err)
+				}
+
+				c := newAlarmCache(3600)
+				if tt.gc {
+					c.setGC(c.clock.Now())
+				}
+
+				a := &alarmServer{
+					session: newSession(vc, ""),
+					cache:   c,
+				}
+				if tt.receiving {
+					a.receiving = 1
+				}
+
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+				a.healthHandler().ServeHTTP(rec, req)
+				assert.Equal(t, rec.Code, tt.wantCode)
+
+				var got healthStatus
+				err := json.NewDecoder(rec.Body).Decode(&got)
+				assert.NilError(t, err)
+
+				gotOK := make(map[string]bool, len(got.Checks))
+				for name, check := range got.Checks {
+					gotOK[name] = check.OK
+					assert.Equal(t, check.OK, check.Error == "", "check %s: %+v", name, check)
+				}
+				assert.DeepEqual(t, gotOK, tt.wantOK)
+			})
+		})
+	}
+}
+
+func Test_sessionProbe_check(t *testing.T) {
+	simulator.Test(func(ctx context.Context, client *vim25.Client) {
+		vc := simulatorClient(t, client)
+		s := newSession(vc, "")
+
+		mock := clock.NewMock()
+		p := newSessionProbe(time.Second * 10)
+		p.clock = mock
+
+		err := p.check(ctx, s)
+		assert.NilError(t, err)
+
+		err = vc.SessionManager.Logout(ctx)
+		assert.NilError(t, err)
+
+		// cached within interval
+		mock.Add(time.Second * 5)
+		err = p.check(ctx, s)
+		assert.NilError(t, err)
+
+		mock.Add(time.Second * 5)
+		err = p.check(ctx, s)
+		assert.Assert(t, err != nil)
+	})
+}
+
+func Test_cache_gcCheck(t *testing.T) {
+	c := newAlarmCache(3600)
+	mock := clock.NewMock()
+	c.clock = mock
+
+	err := c.gcCheck()
+	assert.ErrorContains(t, err, "not running")
+
+	c.setGC(mock.Now())
+	mock.Add(cacheGCInterval * cacheGCStallFactor)
+	err = c.gcCheck()
+	assert.NilError(t, err)
+
+	mock.Add(time.Second)
+	err = c.gcCheck()
+	assert.ErrorContains(t, err, "stalled")
+
+	ctx, cancel := context.WithCancel(logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar()))
+	cancel()
+	err = c.run(ctx)
+	assert.Assert(t, errors.Is(err, context.Canceled))
+	err = c.gcCheck()
+	assert.ErrorContains(t, err, "not running")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// limiter bounds the number of concurrently handled events. Events exceeding
+// the limit wait in a bounded queue. When the queue is full, events are
+// rejected with 429 (Too Many Requests) and a Retry-After header so that the
+// broker backs off. A nil limiter does not limit.
+type limiter struct {
+	slots      chan struct{} // in-flight events
+	tickets    chan struct{} // in-flight and queued events
+	retryAfter time.Duration
+}
+
+// limiterStatus is the admin representation of the limiter
+type limiterStatus struct {
+	MaxInFlight int `json:"maxInFlight"`
+	InFlight    int `json:"inFlight"`
+	QueueSize   int `json:"queueSize"`
+	Queued      int `json:"queued"`
+}
+
+func newLimiter(maxInFlight, queueSize int, retryAfter time.Duration) *limiter {
+	return &limiter{
+		slots:      make(chan struct{}, maxInFlight),
+		tickets:    make(chan struct{}, maxInFlight+queueSize),
+		retryAfter: retryAfter,
+	}
+}
+
+// middleware returns an HTTP middleware limiting concurrent event deliveries
+func (l *limiter) middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only limit event deliveries
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case l.tickets <- struct{}{}:
+			defer func() { <-l.tickets }()
+		default:
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(l.retryAfter.Seconds()))))
+			http.Error(w, "too many in-flight events", http.StatusTooManyRequests)
+			return
+		}
+
+		select {
+		case l.slots <- struct{}{}:
+			defer func() { <-l.slots }()
+		case <-r.Context().Done():
+			// client gave up while queued
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// status returns the current limits and utilization
+func (l *limiter) status() limiterStatus {
+	if l == nil {
+		return limiterStatus{}
+	}
+
+	inFlight := len(l.slots)
+	queued := len(l.tickets) - inFlight
+	if queued < 0 {
+		queued = 0
+	}
+
+	return limiterStatus{
+		MaxInFlight: cap(l.slots),
+		InFlight:    inFlight,
+		QueueSize:   cap(l.tickets) - cap(l.slots),
+		Queued:      queued,
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func Test_limiter_middleware(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	l := newLimiter(1, 1, time.Millisecond*1500)
+
+	srv := httptest.NewServer(l.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})))
+	defer srv.Close()
+
+	codes := make(chan int, 2)
+	post := func() {
+		resp, err := http.Post(srv.URL, "application/json", nil)
+		if err != nil {
+			codes <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		codes <- resp.StatusCode
+	}
+
+	// in flight
+	go post()
+	<-started
+
+	// queued
+	go post()
+	for l.status().Queued != 1 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.DeepEqual(t, l.status(), limiterStatus{MaxInFlight: 1, InFlight: 1, QueueSize: 1, Queued: 1})
+
+	// rejected
+	resp, err := http.Post(srv.URL, "application/json", nil)
+	assert.NilError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusTooManyRequests)
+	assert.Equal(t, resp.Header.Get("Retry-After"), "2")
+
+	close(release)
+	assert.Equal(t, <-codes, http.StatusOK)
+	assert.Equal(t, <-codes, http.StatusOK)
+	assert.DeepEqual(t, l.status(), limiterStatus{MaxInFlight: 1, QueueSize: 1})
+}
+
+func Test_limiter_nil(t *testing.T) {
+	var l *limiter
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	rec := httptest.NewRecorder()
+	l.middleware(next).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, rec.Code, http.StatusAccepted)
+	assert.DeepEqual(t, l.status(), limiterStatus{})
+}
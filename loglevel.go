@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	logLevelPath         = "/loglevel"
+	logLevelPollInterval = time.Second * 10
+)
+
+type logLevelKey struct{}
+
+// withLogLevel returns a context with the level of the logger of the context
+// which can be changed at runtime
+func withLogLevel(ctx context.Context, level zap.AtomicLevel) context.Context {
+	return context.WithValue(ctx, logLevelKey{}, &level)
+}
+
+// logLevelFromContext returns the log level of the context or nil if the level
+// of the logger cannot be changed
+func logLevelFromContext(ctx context.Context) *zap.AtomicLevel {
+	level, _ := ctx.Value(logLevelKey{}).(*zap.AtomicLevel)
+	return level
+}
+
+// handleLogLevel returns (GET) or sets (PUT) the log level, e.g.
+// {"level":"debug"}
+func (a *alarmServer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if a.logLevel == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("log level cannot be changed"))
+		return
+	}
+	a.logLevel.ServeHTTP(w, r)
+}
+
+// watchLogLevel periodically reads the log level from the log level file, e.g.
+// the loglevel key of a mounted knative config-logging ConfigMap, and sets it
+// when the file changed. Changes via the admin endpoint are kept until the file
+// changes.
+func (a *alarmServer) watchLogLevel(ctx context.Context) error {
+	if a.logLevelFile == "" || a.logLevel == nil {
+		return nil
+	}
+
+	logger := logging.FromContext(ctx)
+	var last string
+
+	update := func() {
+		b, err := ioutil.ReadFile(a.logLevelFile)
+		if err != nil {
+			if !os.IsNotExist(err) || last != "" {
+				logger.Warnw("could not read log level file", "file", a.logLevelFile, "error", err)
+			}
+			return
+		}
+
+		text := strings.TrimSpace(string(b))
+		if text == last {
+			return
+		}
+		last = text
+
+		if err = a.logLevel.UnmarshalText([]byte(text)); err != nil {
+			logger.Warnw("invalid log level in file", "file", a.logLevelFile, "level", text, "error", err)
+			return
+		}
+		logger.Infow("log level changed", "level", a.logLevel.String(), "file", a.logLevelFile)
+	}
+
+	update()
+	t := time.NewTicker(logLevelPollInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			update()
+		}
+	}
+}
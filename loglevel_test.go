@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func Test_alarmServer_handleLogLevel(t *testing.T) {
+	tests := []struct {
+		name      string
+		level     *zap.AtomicLevel
+		method    string
+		body      string
+		wantCode  int
+		wantLevel zapcore.Level
+	}{
+		{
+			name:      "get level",
+			level:     atomicLevel(zapcore.InfoLevel),
+			method:    http.MethodGet,
+			wantCode:  http.StatusOK,
+			wantLevel: zapcore.InfoLevel,
+		},
+		{
+			name:      "set level",
+			level:     atomicLevel(zapcore.InfoLevel),
+			method:    http.MethodPut,
+			body:      `{"level":"debug"}`,
+			wantCode:  http.StatusOK,
+			wantLevel: zapcore.DebugLevel,
+		},
+		{
+			name:      "invalid level",
+			level:     atomicLevel(zapcore.InfoLevel),
+			method:    http.MethodPut,
+			body:      `{"level":"verbose"}`,
+			wantCode:  http.StatusBadRequest,
+			wantLevel: zapcore.InfoLevel,
+		},
+		{
+			name:     "level cannot be changed",
+			level:    nil,
+			method:   http.MethodGet,
+			wantCode: http.StatusNotImplemented,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &alarmServer{logLevel: tt.level}
+			ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "/loglevel", strings.NewReader(tt.body))
+			a.adminHandler(ctx).ServeHTTP(rec, req)
+
+			assert.Equal(t, rec.Code, tt.wantCode)
+			if tt.level != nil {
+				assert.Equal(t, tt.level.Level(), tt.wantLevel)
+			}
+		})
+	}
+}
+
+func Test_alarmServer_watchLogLevel(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "loglevel.vsphere-alarm-server")
+	err := ioutil.WriteFile(file, []byte("debug\n"), 0o644)
+	assert.NilError(t, err)
+
+	level := atomicLevel(zapcore.InfoLevel)
+	a := &alarmServer{logLevel: level, logLevelFile: file}
+
+	ctx, cancel := context.WithCancel(logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar()))
+	done := make(chan error)
+	go func() {
+		done <- a.watchLogLevel(ctx)
+	}()
+
+	for i := 0; level.Level() != zapcore.DebugLevel; i++ {
+		assert.Assert(t, i < 100, "log level not read from file")
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	cancel()
+	assert.NilError(t, <-done)
+}
+
+func atomicLevel(l zapcore.Level) *zap.AtomicLevel {
+	level := zap.NewAtomicLevelAt(l)
+	return &level
+}
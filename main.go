@@ -20,6 +20,8 @@ var (
 
 func main() {
 	printVersion := flag.Bool("v", false, "print version information")
+	resubmitFile := flag.String("resubmit", "", "resubmit all events from the specified dead-letter file and exit")
+	target := flag.String("target", "", "target URL for resubmitted events, e.g. the broker ingress")
 	flag.Parse()
 
 	if *printVersion {
@@ -28,31 +30,50 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *resubmitFile != "" {
+		if *target == "" {
+			fmt.Fprintln(os.Stderr, "-target is required with -resubmit")
+			os.Exit(1)
+		}
+
+		n, err := resubmit(signals.NewContext(), *resubmitFile, *target)
+		fmt.Printf("resubmitted %d events\n", n)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "resubmit events: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	var env envConfig
 	if err := envconfig.Process(envPrefix, &env); err != nil {
 		panic(fmt.Errorf("process env var: %w", err).Error())
 	}
 
 	ctx := signals.NewContext()
-	var logger *zap.SugaredLogger
 
-	if env.Debug {
-		logDev, err := zap.NewDevelopment()
-		if err != nil {
-			panic(fmt.Errorf("create logger: %w", err).Error())
-		}
-		logger = logDev.Sugar()
+	var (
+		cfg  zap.Config
+		opts []zap.Option
+	)
 
+	if env.Debug {
+		cfg = zap.NewDevelopmentConfig()
 	} else {
-		logProd, err := zap.NewProduction(zap.AddStacktrace(zap.ErrorLevel))
-		if err != nil {
-			panic(fmt.Errorf("create logger: %w", err).Error())
-		}
-		logger = logProd.Sugar()
+		cfg = zap.NewProductionConfig()
+		opts = append(opts, zap.AddStacktrace(zap.ErrorLevel))
+	}
+
+	// cfg.Level allows changing the log level at runtime
+	zl, err := cfg.Build(opts...)
+	if err != nil {
+		panic(fmt.Errorf("create logger: %w", err).Error())
 	}
+	logger := zl.Sugar()
 
 	logger = logger.Named("vsphere-alarm-server").With("commit", buildCommit, "tag", buildTag)
 	ctx = logging.WithLogger(ctx, logger)
+	ctx = withLogLevel(ctx, cfg.Level)
 
 	if err := run(ctx, os.Args); err != nil && !errors.Is(err, context.Canceled) {
 		logger.Fatalf("error running server: %v", err)
@@ -71,7 +92,7 @@ func run(ctx context.Context, _ []string) error {
 	}
 
 	logger := logging.FromContext(ctx)
-	logger.Infow("starting vsphere alarm server", "port", env.Port, "cache_ttl", srv.cache.ttl, "debug", env.Debug, "event_suffix", env.EventSuffix, "alarm_info_key", env.InjectKey)
+	logger.Infow("starting vsphere alarm server", "port", env.Port, "admin_host", env.AdminHost, "admin_port", env.AdminPort, "health_port", env.HealthPort, "metrics_port", env.MetricsPort, "cache_ttl", srv.cache.ttl, "debug", env.Debug, "event_suffix", env.EventSuffix, "alarm_info_key", env.InjectKey, "retry_attempts", env.RetryAttempts, "breaker_threshold", env.BreakerThreshold)
 
 	return srv.run(ctx)
 }
@@ -32,6 +32,9 @@ func Test_run(t *testing.T) {
 			Insecure:   true, // vcsim
 		},
 		Port:        50001,
+		AdminPort:   50002,
+		HealthPort:  50005,
+		MetricsPort: 50004,
 		EventSuffix: "AlarmInfo",
 		InjectKey:   "AlarmInfo",
 	}
@@ -150,6 +153,18 @@ func setEnv(env envConfig) error {
 		return err
 	}
 
+	if err := os.Setenv("METRICS_PORT", strconv.Itoa(env.MetricsPort)); err != nil {
+		return err
+	}
+
+	if err := os.Setenv("ADMIN_PORT", strconv.Itoa(env.AdminPort)); err != nil {
+		return err
+	}
+
+	if err := os.Setenv("HEALTH_PORT", strconv.Itoa(env.HealthPort)); err != nil {
+		return err
+	}
+
 	if err := os.Setenv("EVENT_SUFFIX", env.EventSuffix); err != nil {
 		return err
 	}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	metricsPath      = "/metrics"
+	metricsNamespace = "vsphere_alarm_server"
+)
+
+// event outcomes
+const (
+	outcomeEnriched   = "enriched"
+	outcomeIgnored    = "ignored"
+	outcomeDegraded   = "degraded" // passed through without alarm info
+	outcomeFailed     = "failed"
+	outcomeRejected   = "rejected"   // not handled, e.g. during shutdown
+	outcomeDropped    = "dropped"    // dropped by a rule
+	outcomePassed     = "passed"     // returned without alarm info by a rule
+	outcomeHeld       = "held"       // held until the transition is stable
+	outcomeSuppressed = "suppressed" // reverted a held transition
+)
+
+// reasons for ignored, rejected, held and suppressed events, failed and
+// degraded events use the failure class and events matching a rule the rule
+// name as reason
+const (
+	reasonSelf      = "self"
+	reasonNotJSON   = "not_json"
+	reasonNotAlarm  = "not_alarm"
+	reasonShutdown  = "shutdown"
+	reasonDuplicate = "duplicate"
+	reasonDebounce  = "debounce"
+)
+
+// login reasons
+const (
+	loginRelogin  = "relogin"
+	loginRotation = "rotation"
+)
+
+// retrievalBuckets are the upper bounds in seconds of the vCenter retrieval
+// latency histogram
+var retrievalBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metrics collects the server metrics in a Prometheus registry. A nil metrics
+// does not record.
+type metrics struct {
+	registry    *prometheus.Registry
+	events      *counterVec
+	cacheHits   *counterVec
+	cacheMisses *counterVec
+	logins      *counterVec
+	transitions *counterVec
+	deliveries  *counterVec
+	retrieval   prometheus.Histogram
+
+	sync.Mutex
+	sample func() gauges // samples the gauges on collection
+}
+
+// gauges are the metrics sampled when collected
+type gauges struct {
+	cacheSize int
+	flapping  int
+	flaps     []alarmStats // transitions within the flap window per alarm and entity
+	held      int
+}
+
+func newMetrics() *metrics {
+	r := prometheus.NewRegistry()
+	m := &metrics{
+		registry: r,
+		// the event type is not a label since it is not bounded
+		events:      newCounterVec(r, "events_total", "Number of received events by outcome and reason.", "outcome", "reason"),
+		cacheHits:   newCounterVec(r, "cache_hits_total", "Number of alarm lookups served from the cache."),
+		cacheMisses: newCounterVec(r, "cache_misses_total", "Number of alarm lookups not found in the cache."),
+		logins:      newCounterVec(r, "vcenter_logins_total", "Number of vCenter logins after the initial connection by reason and result.", "reason", "result"),
+		transitions: newCounterVec(r, "alarm_transitions_total", "Number of alarm status transitions by alarm.", "alarm"),
+		deliveries:  newCounterVec(r, "sink_deliveries_total", "Number of events sent to sinks by sink and result.", "sink", "result"),
+		retrieval: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "vcenter_retrieval_duration_seconds",
+			Help:      "Latency of alarm retrievals from vCenter including retries.",
+			Buckets:   retrievalBuckets,
+		}),
+	}
+	r.MustRegister(m.retrieval, gaugeCollector{m})
+	return m
+}
+
+func (m *metrics) event(outcome, reason string) {
+	if m == nil {
+		return
+	}
+	m.events.inc(outcome, reason)
+}
+
+func (m *metrics) cacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.cacheHits.inc()
+		return
+	}
+	m.cacheMisses.inc()
+}
+
+func (m *metrics) login(reason string, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.logins.inc(reason, result)
+}
+
+func (m *metrics) transition(alarm string) {
+	if m == nil {
+		return
+	}
+	m.transitions.inc(alarm)
+}
+
+func (m *metrics) delivery(sink string, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.deliveries.inc(sink, result)
+}
+
+func (m *metrics) observeRetrieval(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.retrieval.Observe(d.Seconds())
+}
+
+// outcomes returns the number of events by outcome
+func (m *metrics) outcomes() map[string]float64 {
+	outcomes := map[string]float64{}
+	if m == nil {
+		return outcomes
+	}
+
+	for _, s := range m.events.samples() {
+		for _, l := range s.GetLabel() {
+			if l.GetName() == "outcome" {
+				outcomes[l.GetValue()] += s.GetCounter().GetValue()
+			}
+		}
+	}
+	return outcomes
+}
+
+// setGauges sets the function sampling the gauges on collection
+func (m *metrics) setGauges(sample func() gauges) {
+	m.Lock()
+	defer m.Unlock()
+	m.sample = sample
+}
+
+// runMetrics starts the metrics HTTP server and blocks until the context is
+// cancelled. A zero metrics port disables the metrics server.
+func (a *alarmServer) runMetrics(ctx context.Context) error {
+	if a.metricsPort == 0 {
+		return nil
+	}
+
+	if err := serveHTTP(ctx, "", a.metricsPort, a.metricsHandler()); err != nil {
+		return fmt.Errorf("run metrics server: %w", err)
+	}
+	return nil
+}
+
+// metricsHandler returns the HTTP handler serving the metrics
+func (a *alarmServer) metricsHandler() http.Handler {
+	a.metrics.setGauges(func() gauges {
+		flaps := a.flaps.stats()
+		return gauges{
+			cacheSize: len(a.cache.keys()),
+			flapping:  countFlapping(flaps),
+			flaps:     flaps,
+			held:      a.debounce.held(),
+		}
+	})
+
+	metricsHandler := promhttp.HandlerFor(a.metrics.registry, promhttp.HandlerOpts{})
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		metricsHandler.ServeHTTP(w, r)
+	})
+	return mux
+}
+
+// counterVec is a Prometheus counter partitioned by label values
+type counterVec struct {
+	*prometheus.CounterVec
+}
+
+// newCounterVec registers a counter with the specified labels. Counters without
+// labels are exposed before the first increment.
+func newCounterVec(r prometheus.Registerer, name, help string, labels ...string) *counterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      name,
+		Help:      help,
+	}, labels)
+	r.MustRegister(c)
+	if len(labels) == 0 {
+		c.WithLabelValues()
+	}
+	return &counterVec{c}
+}
+
+// inc increments the counter with the specified label values which must match
+// the labels of the counter
+func (c *counterVec) inc(values ...string) {
+	c.WithLabelValues(values...).Inc()
+}
+
+// get returns the value of the counter with the specified label values
+func (c *counterVec) get(values ...string) float64 {
+	var s dto.Metric
+	if err := c.WithLabelValues(values...).Write(&s); err != nil {
+		return 0
+	}
+	return s.GetCounter().GetValue()
+}
+
+// samples returns the current values of all label combinations
+func (c *counterVec) samples() []*dto.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	var samples []*dto.Metric
+	for metric := range ch {
+		var s dto.Metric
+		if err := metric.Write(&s); err == nil {
+			samples = append(samples, &s)
+		}
+	}
+	return samples
+}
+
+var (
+	cacheSizeDesc      = newGaugeDesc("cache_size", "Number of cached alarms.")
+	flappingAlarmsDesc = newGaugeDesc("flapping_alarms", "Number of flapping alarms per entity.")
+	// bounded by FLAP_MAX_ALARMS
+	flapScoreDesc  = newGaugeDesc("alarm_flap_score", "Number of status transitions within the flap window per alarm and entity.", "alarm", "entity")
+	heldEventsDesc = newGaugeDesc("held_events", "Number of alarm events held until their transition is stable.")
+)
+
+func newGaugeDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", name), help, labels, nil)
+}
+
+// gaugeCollector collects the gauges sampled by the server
+type gaugeCollector struct {
+	m *metrics
+}
+
+func (g gaugeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheSizeDesc
+	ch <- flappingAlarmsDesc
+	ch <- flapScoreDesc
+	ch <- heldEventsDesc
+}
+
+func (g gaugeCollector) Collect(ch chan<- prometheus.Metric) {
+	g.m.Lock()
+	sample := g.m.sample
+	g.m.Unlock()
+
+	var s gauges
+	if sample != nil {
+		s = sample()
+	}
+
+	ch <- prometheus.MustNewConstMetric(cacheSizeDesc, prometheus.GaugeValue, float64(s.cacheSize))
+	ch <- prometheus.MustNewConstMetric(flappingAlarmsDesc, prometheus.GaugeValue, float64(s.flapping))
+	for _, f := range s.flaps {
+		ch <- prometheus.MustNewConstMetric(flapScoreDesc, prometheus.GaugeValue, float64(f.Transitions), f.Alarm, f.Entity)
+	}
+	ch <- prometheus.MustNewConstMetric(heldEventsDesc, prometheus.GaugeValue, float64(s.held))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+)
+
+func Test_metrics_gather(t *testing.T) {
+	m := newMetrics()
+	m.event(outcomeEnriched, "")
+	m.event(outcomeEnriched, "")
+	m.event(outcomeIgnored, reasonNotAlarm)
+	m.event(outcomeFailed, string(failureDecode))
+	m.cacheLookup(true)
+	m.cacheLookup(false)
+	m.login(loginRelogin, nil)
+	m.login(loginRotation, errNotConnected)
+	m.observeRetrieval(time.Millisecond * 20)
+	m.observeRetrieval(time.Millisecond * 300)
+	m.observeRetrieval(time.Minute)
+	m.transition("alarm-1")
+	m.delivery("http://sink", nil)
+
+	flaps := []alarmStats{
+		{Alarm: "Alarm:alarm-1", Entity: "HostSystem:host-1", Transitions: 12, Flapping: true},
+		{Alarm: "Alarm:alarm-2", Entity: "VirtualMachine:vm-1", Transitions: 0},
+	}
+	m.setGauges(func() gauges {
+		return gauges{cacheSize: 2, flapping: 1, flaps: flaps, held: 3}
+	})
+
+	want := `# HELP vsphere_alarm_server_events_total Number of received events by outcome and reason.
+# TYPE vsphere_alarm_server_events_total counter
+vsphere_alarm_server_events_total{outcome="enriched",reason=""} 2
+vsphere_alarm_server_events_total{outcome="failed",reason="decode"} 1
+vsphere_alarm_server_events_total{outcome="ignored",reason="not_alarm"} 1
+# HELP vsphere_alarm_server_cache_hits_total Number of alarm lookups served from the cache.
+# TYPE vsphere_alarm_server_cache_hits_total counter
+vsphere_alarm_server_cache_hits_total 1
+# HELP vsphere_alarm_server_cache_misses_total Number of alarm lookups not found in the cache.
+# TYPE vsphere_alarm_server_cache_misses_total counter
+vsphere_alarm_server_cache_misses_total 1
+# HELP vsphere_alarm_server_cache_size Number of cached alarms.
+# TYPE vsphere_alarm_server_cache_size gauge
+vsphere_alarm_server_cache_size 2
+# HELP vsphere_alarm_server_vcenter_retrieval_duration_seconds Latency of alarm retrievals from vCenter including retries.
+# TYPE vsphere_alarm_server_vcenter_retrieval_duration_seconds histogram
+vsphere_alarm_server_vcenter_retrieval_duration_seconds_bucket{le="0.01"} 0
+vsphere_alarm_server_vcenter_retrieval_duration_seconds_bucket{le="0.025"} 1
+vsphere_alarm_server_vcenter_retrieval_duration_seconds_bucket{le="0.05"} 1
+vsphere_alarm_server_vcenter_retrieval_duration_seconds_bucket{le="0.1"} 1
+vsphere_alarm_server_vcenter_retrieval_duration_seconds_bucket{le="0.25"} 1
+vsphere_alarm_server_vcenter_retrieval_duration_seconds_bucket{le="0.5"} 2
+vsphere_alarm_server_vcenter_retrieval_duration_seconds_bucket{le="1"} 2
+vsphere_alarm_server_vcenter_retrieval_duration_seconds_bucket{le="2.5"} 2
+vsphere_alarm_server_vcenter_retrieval_duration_seconds_bucket{le="5"} 2
+vsphere_alarm_server_vcenter_retrieval_duration_seconds_bucket{le="10"} 2
+vsphere_alarm_server_vcenter_retrieval_duration_seconds_bucket{le="30"} 2
+vsphere_alarm_server_vcenter_retrieval_duration_seconds_bucket{le="+Inf"} 3
+vsphere_alarm_server_vcenter_retrieval_duration_seconds_sum 60.32
+vsphere_alarm_server_vcenter_retrieval_duration_seconds_count 3
+# HELP vsphere_alarm_server_vcenter_logins_total Number of vCenter logins after the initial connection by reason and result.
+# TYPE vsphere_alarm_server_vcenter_logins_total counter
+vsphere_alarm_server_vcenter_logins_total{reason="relogin",result="success"} 1
+vsphere_alarm_server_vcenter_logins_total{reason="rotation",result="failure"} 1
+# HELP vsphere_alarm_server_alarm_transitions_total Number of alarm status transitions by alarm.
+# TYPE vsphere_alarm_server_alarm_transitions_total counter
+vsphere_alarm_server_alarm_transitions_total{alarm="alarm-1"} 1
+# HELP vsphere_alarm_server_sink_deliveries_total Number of events sent to sinks by sink and result.
+# TYPE vsphere_alarm_server_sink_deliveries_total counter
+vsphere_alarm_server_sink_deliveries_total{result="success",sink="http://sink"} 1
+# HELP vsphere_alarm_server_flapping_alarms Number of flapping alarms per entity.
+# TYPE vsphere_alarm_server_flapping_alarms gauge
+vsphere_alarm_server_flapping_alarms 1
+# HELP vsphere_alarm_server_alarm_flap_score Number of status transitions within the flap window per alarm and entity.
+# TYPE vsphere_alarm_server_alarm_flap_score gauge
+vsphere_alarm_server_alarm_flap_score{alarm="Alarm:alarm-1",entity="HostSystem:host-1"} 12
+vsphere_alarm_server_alarm_flap_score{alarm="Alarm:alarm-2",entity="VirtualMachine:vm-1"} 0
+# HELP vsphere_alarm_server_held_events Number of alarm events held until their transition is stable.
+# TYPE vsphere_alarm_server_held_events gauge
+vsphere_alarm_server_held_events 3
+`
+	err := testutil.GatherAndCompare(m.registry, strings.NewReader(want))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, m.outcomes(), map[string]float64{outcomeEnriched: 2, outcomeFailed: 1, outcomeIgnored: 1})
+}
+
+func Test_alarmServer_metricsHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		wantCode int
+	}{
+		{
+			name:     "get metrics",
+			method:   http.MethodGet,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "invalid method",
+			method:   http.MethodPost,
+			wantCode: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newAlarmCache(3600)
+			c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+			a := &alarmServer{cache: c, metrics: newMetrics()}
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "/metrics", nil)
+			a.metricsHandler().ServeHTTP(rec, req)
+
+			assert.Equal(t, rec.Code, tt.wantCode)
+			if tt.wantCode == http.StatusOK {
+				assert.Assert(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+				assert.Assert(t, strings.Contains(rec.Body.String(), "\nvsphere_alarm_server_cache_size 1\n"))
+			}
+		})
+	}
+}
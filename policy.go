@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"knative.dev/pkg/logging"
+)
+
+// failureClass classifies why an event could not be enriched
+type failureClass string
+
+const (
+	failureDecode  failureClass = "decode"  // event data is not a valid vCenter event
+	failureVCenter failureClass = "vcenter" // alarm could not be retrieved from vCenter
+	failurePatch   failureClass = "patch"   // alarm info could not be injected into the event data
+	failureSink    failureClass = "sink"    // returned event could not be delivered to all sinks
+)
+
+// failureAction is the action taken for a failed event
+type failureAction string
+
+const (
+	// actionAck acknowledges and drops the event (default)
+	actionAck failureAction = "ack"
+	// actionPassthrough returns the event without alarm info (degraded)
+	actionPassthrough failureAction = "passthrough"
+	// actionNACK rejects the event with an HTTP error status so that the
+	// broker retries the delivery or sends the event to a dead-letter sink
+	actionNACK failureAction = "nack"
+)
+
+// failurePolicy configures the action per failure class. The zero value
+// acknowledges and drops all failed events.
+type failurePolicy struct {
+	decode  failureAction
+	vcenter failureAction
+	patch   failureAction
+	sink    failureAction // ack or nack
+}
+
+func (p failurePolicy) action(class failureClass) failureAction {
+	var a failureAction
+	switch class {
+	case failureDecode:
+		a = p.decode
+	case failureVCenter:
+		a = p.vcenter
+	case failurePatch:
+		a = p.patch
+	case failureSink:
+		a = p.sink
+	}
+
+	if a == "" {
+		return actionAck
+	}
+	return a
+}
+
+// status returns the HTTP status code used to reject events of the failure
+// class
+func (c failureClass) status() int {
+	switch c {
+	case failureDecode:
+		// permanent, redelivery will not help
+		return http.StatusBadRequest
+	case failureVCenter:
+		return http.StatusServiceUnavailable
+	case failureSink:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// fail handles an event which could not be enriched according to the action
+// configured for the failure class. Events which are not rejected for
+// redelivery are sent to the dead-letter sink (if configured).
+func (a *alarmServer) fail(ctx context.Context, event cloudevents.Event, class failureClass, err error) (*cloudevents.Event, cloudevents.Result) {
+	action := a.policy.action(class)
+	logging.FromContext(ctx).Debugw("handling failed event", "id", event.ID(), "class", class, "action", action, "error", err)
+
+	if action != actionNACK {
+		a.deadLetter(ctx, event, class, err)
+	}
+
+	outcome := outcomeFailed
+	if action == actionPassthrough {
+		outcome = outcomeDegraded
+	}
+	a.outcome(ctx, event, outcome, string(class))
+
+	d := decisionFrom(ctx)
+	d.step("apply %s failure policy: %s", class, action)
+
+	switch action {
+	case actionPassthrough:
+		resp := a.degradedEvent(ctx, event, err)
+		if d != nil {
+			d.output = resp
+		}
+		return resp, nil
+	case actionNACK:
+		return nil, cehttp.NewResult(class.status(), "%s: %w", class, err)
+	default:
+		return nil, nil
+	}
+}
+
+// newFailurePolicy returns the failure policy configured in env
+func newFailurePolicy(env envConfig) (failurePolicy, error) {
+	var (
+		p   failurePolicy
+		err error
+	)
+
+	if p.decode, err = parseFailureAction(env.DecodeFailurePolicy); err != nil {
+		return p, fmt.Errorf("DECODE_FAILURE_POLICY: %w", err)
+	}
+	if p.vcenter, err = parseFailureAction(env.VCenterFailurePolicy); err != nil {
+		return p, fmt.Errorf("VCENTER_FAILURE_POLICY: %w", err)
+	}
+	if p.patch, err = parseFailureAction(env.PatchFailurePolicy); err != nil {
+		return p, fmt.Errorf("PATCH_FAILURE_POLICY: %w", err)
+	}
+	if p.sink, err = parseFailureAction(env.SinkFailurePolicy); err != nil {
+		return p, fmt.Errorf("SINK_FAILURE_POLICY: %w", err)
+	}
+	if p.sink == actionPassthrough {
+		return p, fmt.Errorf("SINK_FAILURE_POLICY: %q is not supported, use %q or %q", actionPassthrough, actionAck, actionNACK)
+	}
+	return p, nil
+}
+
+// parseFailureAction parses the specified failure action, an empty string
+// returns the default action
+func parseFailureAction(s string) (failureAction, error) {
+	switch a := failureAction(s); a {
+	case "":
+		return actionAck, nil
+	case actionAck, actionPassthrough, actionNACK:
+		return a, nil
+	default:
+		return "", fmt.Errorf("invalid failure action %q: must be one of %q, %q or %q", s, actionAck, actionPassthrough, actionNACK)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/kelseyhightower/envconfig"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func Test_alarmServer_handleEvent_failurePolicy(t *testing.T) {
+	testEvents := createCloudEvents(t)
+
+	invalidEvent := cloudevents.NewEvent()
+	invalidEvent.SetSource(vc)
+	invalidEvent.SetType("AlarmStatusChangedEvent")
+	err := invalidEvent.SetData(cloudevents.ApplicationJSON, []byte(`{"Key":"not-a-number"}`))
+	assert.NilError(t, err)
+
+	tests := []struct {
+		name       string
+		policy     failurePolicy
+		event      cloudevents.Event
+		wantEvent  bool
+		wantType   string
+		wantStatus int // 0 for ACK
+	}{
+		{
+			name:   "decode failure with default policy",
+			policy: failurePolicy{},
+			event:  invalidEvent,
+		},
+		{
+			name:      "decode failure with passthrough",
+			policy:    failurePolicy{decode: actionPassthrough},
+			event:     invalidEvent,
+			wantEvent: true,
+			wantType:  "AlarmStatusChangedEvent." + suffix + ".Degraded",
+		},
+		{
+			name:       "decode failure with nack",
+			policy:     failurePolicy{decode: actionNACK},
+			event:      invalidEvent,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:   "vcenter failure with ack",
+			policy: failurePolicy{vcenter: actionAck},
+			event:  *testEvents["AlarmStatusChangedEvent"],
+		},
+		{
+			name:      "vcenter failure with passthrough",
+			policy:    failurePolicy{vcenter: actionPassthrough},
+			event:     *testEvents["AlarmStatusChangedEvent"],
+			wantEvent: true, // circuit breaker open returns degraded event
+			wantType:  "AlarmStatusChangedEvent." + suffix + ".Degraded",
+		},
+		{
+			name:       "vcenter failure with nack",
+			policy:     failurePolicy{vcenter: actionNACK},
+			event:      *testEvents["AlarmStatusChangedEvent"],
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBreaker(1, time.Hour, nil)
+			b.allow()
+			b.record(context.DeadlineExceeded)
+
+			a := &alarmServer{
+				cache:     newAlarmCache(3600),
+				breaker:   b,
+				source:    vc,
+				suffix:    "." + suffix,
+				injectKey: injectKey,
+				degraded:  ".Degraded",
+				policy:    tt.policy,
+			}
+			ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+			got, result := a.handleEvent(ctx, tt.event)
+			if tt.wantEvent {
+				assert.Assert(t, got != nil)
+				assert.Equal(t, got.Type(), tt.wantType)
+				assert.DeepEqual(t, got.Data(), tt.event.Data())
+			} else {
+				assert.Assert(t, got == nil)
+			}
+
+			if tt.wantStatus == 0 {
+				assert.Assert(t, result == nil, "result: %v", result)
+				return
+			}
+
+			var httpResult *cehttp.Result
+			assert.Assert(t, errors.As(result, &httpResult), "result: %v", result)
+			assert.Equal(t, httpResult.StatusCode, tt.wantStatus)
+		})
+	}
+}
+
+func Test_newFailurePolicy(t *testing.T) {
+	p, err := newFailurePolicy(envConfig{VCenterFailurePolicy: "nack", PatchFailurePolicy: "passthrough", SinkFailurePolicy: "nack"})
+	assert.NilError(t, err)
+	assert.Equal(t, p, failurePolicy{decode: actionAck, vcenter: actionNACK, patch: actionPassthrough, sink: actionNACK})
+
+	// defaults
+	t.Setenv("EVENT_SUFFIX", suffix)
+	t.Setenv("ALARM_KEY", injectKey)
+	var env envConfig
+	assert.NilError(t, envconfig.Process("", &env))
+	p, err = newFailurePolicy(env)
+	assert.NilError(t, err)
+	assert.Equal(t, p, failurePolicy{decode: actionAck, vcenter: actionPassthrough, patch: actionAck, sink: actionNACK})
+
+	_, err = newFailurePolicy(envConfig{DecodeFailurePolicy: "retry"})
+	assert.ErrorContains(t, err, "DECODE_FAILURE_POLICY")
+
+	_, err = newFailurePolicy(envConfig{SinkFailurePolicy: "passthrough"})
+	assert.ErrorContains(t, err, "SINK_FAILURE_POLICY")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+const recentPath = "/events"
+
+// recentEvent is the admin representation of a processed event
+type recentEvent struct {
+	Processed  time.Time     `json:"processed"`
+	DurationMs float64       `json:"durationMs"`
+	Input      recentInput   `json:"input"`
+	MoRef      string        `json:"moref,omitempty"`
+	Alarm      string        `json:"alarm,omitempty"`
+	CacheHit   *bool         `json:"cacheHit,omitempty"`
+	Outcome    string        `json:"outcome"`
+	Reason     string        `json:"reason,omitempty"`
+	Path       []string      `json:"path"`
+	Output     *recentOutput `json:"output,omitempty"`
+}
+
+// recentInput holds the attributes of a received event
+type recentInput struct {
+	ID              string     `json:"id"`
+	Source          string     `json:"source"`
+	Type            string     `json:"type"`
+	Subject         string     `json:"subject,omitempty"`
+	Time            *time.Time `json:"time,omitempty"`
+	DataContentType string     `json:"datacontenttype,omitempty"`
+}
+
+// recentOutput holds the returned event
+type recentOutput struct {
+	Type      string `json:"type"`
+	Payload   string `json:"payload,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// recentEvents is a ring buffer of the most recently processed events. A nil
+// buffer does not record.
+type recentEvents struct {
+	payloadSize int // max payload bytes of returned events, 0 omits payloads
+
+	sync.Mutex
+	events []recentEvent
+	next   int // index of the next event to write
+	full   bool
+}
+
+func newRecentEvents(size, payloadSize int) *recentEvents {
+	return &recentEvents{
+		payloadSize: payloadSize,
+		events:      make([]recentEvent, size),
+	}
+}
+
+// add records the decision for the specified event, overwriting the oldest
+// event when full
+func (r *recentEvents) add(event cloudevents.Event, d *decision, now time.Time) {
+	if r == nil || len(r.events) == 0 {
+		return
+	}
+
+	e := recentEvent{
+		Processed:  now.UTC(),
+		DurationMs: float64(now.Sub(d.start).Microseconds()) / 1000,
+		Input: recentInput{
+			ID:              event.ID(),
+			Source:          event.Source(),
+			Type:            event.Type(),
+			Subject:         event.Subject(),
+			DataContentType: event.DataContentType(),
+		},
+		MoRef:   d.moref,
+		Alarm:   d.alarm,
+		Outcome: d.outcome,
+		Reason:  d.reason,
+		Path:    d.path,
+	}
+
+	if t := event.Time(); !t.IsZero() {
+		e.Input.Time = &t
+	}
+
+	if d.moref != "" {
+		hit := d.cacheHit
+		e.CacheHit = &hit
+	}
+
+	if d.output != nil {
+		e.Output = &recentOutput{Type: d.output.Type()}
+		if r.payloadSize > 0 {
+			payload := d.output.Data()
+			if len(payload) > r.payloadSize {
+				payload = payload[:r.payloadSize]
+				e.Output.Truncated = true
+			}
+			e.Output.Payload = string(payload)
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.events[r.next] = e
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// recentFilter selects recent events
+type recentFilter struct {
+	alarm   string // case-insensitive substring of the alarm name
+	moref   string
+	outcome string
+	limit   int // 0 returns all matching events
+}
+
+func (f recentFilter) match(e recentEvent) bool {
+	if f.outcome != "" && e.Outcome != f.outcome {
+		return false
+	}
+	if f.moref != "" && e.MoRef != f.moref {
+		return false
+	}
+	if f.alarm != "" && !strings.Contains(strings.ToLower(e.Alarm), strings.ToLower(f.alarm)) {
+		return false
+	}
+	return true
+}
+
+// list returns the matching events, most recent first
+func (r *recentEvents) list(f recentFilter) []recentEvent {
+	events := []recentEvent{}
+	if r == nil || len(r.events) == 0 {
+		return events
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.events)
+	}
+
+	for i := 1; i <= n; i++ {
+		e := r.events[(r.next-i+len(r.events))%len(r.events)]
+		if !f.match(e) {
+			continue
+		}
+		events = append(events, e)
+		if f.limit > 0 && len(events) == f.limit {
+			break
+		}
+	}
+	return events
+}
+
+// handleRecent returns the recently processed events, optionally filtered by
+// alarm name (alarm), alarm moref (moref), outcome (outcome) and number of events (limit)
+func (a *alarmServer) handleRecent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	q := r.URL.Query()
+	f := recentFilter{
+		alarm:   q.Get("alarm"),
+		moref:   q.Get("moref"),
+		outcome: q.Get("outcome"),
+	}
+
+	if l := q.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", l))
+			return
+		}
+		f.limit = limit
+	}
+
+	writeJSON(w, http.StatusOK, a.recent.list(f))
+}
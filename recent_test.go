@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func Test_recentEvents_list(t *testing.T) {
+	r := newRecentEvents(3, 0)
+	now := time.Now()
+
+	outcomes := []string{outcomeIgnored, outcomeEnriched, outcomeFailed, outcomeEnriched}
+	for i, o := range outcomes {
+		event := cloudevents.NewEvent()
+		event.SetID(strconv.Itoa(i))
+		r.add(event, &decision{start: now, outcome: o, moref: "Alarm:alarm-" + strconv.Itoa(i), alarm: "Host CPU Usage " + strconv.Itoa(i)}, now)
+	}
+
+	ids := func(events []recentEvent) []string {
+		got := []string{}
+		for _, e := range events {
+			got = append(got, e.Input.ID)
+		}
+		return got
+	}
+
+	tests := []struct {
+		name   string
+		filter recentFilter
+		want   []string
+	}{
+		{name: "oldest event is overwritten", filter: recentFilter{}, want: []string{"3", "2", "1"}},
+		{name: "filter by outcome", filter: recentFilter{outcome: outcomeEnriched}, want: []string{"3", "1"}},
+		{name: "filter by alarm name", filter: recentFilter{alarm: "cpu usage 2"}, want: []string{"2"}},
+		{name: "filter by moref", filter: recentFilter{moref: "Alarm:alarm-1"}, want: []string{"1"}},
+		{name: "limit", filter: recentFilter{limit: 2}, want: []string{"3", "2"}},
+		{name: "no match", filter: recentFilter{outcome: outcomeDegraded}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.DeepEqual(t, ids(r.list(tt.filter)), tt.want)
+		})
+	}
+}
+
+func Test_alarmServer_handleRecent(t *testing.T) {
+	testEvents := createCloudEvents(t)
+
+	c := newAlarmCache(3600)
+	c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+
+	a := &alarmServer{
+		session:   newSession(nil, ""),
+		cache:     c,
+		clock:     clock.NewMock(),
+		source:    vc,
+		suffix:    "." + suffix,
+		injectKey: injectKey,
+		recent:    newRecentEvents(10, 16),
+	}
+	ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+	_, _ = a.handleEvent(ctx, *testEvents["VmPoweredOnEvent"])
+	_, _ = a.handleEvent(ctx, *testEvents["AlarmStatusChangedEvent"])
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		want     []recentEvent
+	}{
+		{
+			name:     "filter by alarm",
+			query:    "?alarm=alarm-1",
+			wantCode: http.StatusOK,
+			want: []recentEvent{{
+				Processed: a.now().UTC(),
+				Input: recentInput{
+					Source:          vc,
+					Type:            "AlarmStatusChangedEvent",
+					DataContentType: cloudevents.ApplicationJSON,
+				},
+				MoRef:    "Alarm:alarm-1",
+				Alarm:    "alarm-1",
+				CacheHit: boolPtr(true),
+				Outcome:  outcomeEnriched,
+				Path: []string{
+					"look up Alarm:alarm-1 in cache: found=true",
+					"return enriched event",
+				},
+				Output: &recentOutput{
+					Type:      "AlarmStatusChangedEvent." + suffix,
+					Payload:   `{"Key":1,"ChainI`,
+					Truncated: true,
+				},
+			}},
+		},
+		{
+			name:     "filter by outcome",
+			query:    "?outcome=ignored",
+			wantCode: http.StatusOK,
+			want: []recentEvent{{
+				Processed: a.now().UTC(),
+				Input: recentInput{
+					Source:          vc,
+					Type:            "VmPoweredOnEvent",
+					DataContentType: cloudevents.ApplicationJSON,
+				},
+				Outcome: outcomeIgnored,
+				Reason:  reasonNotAlarm,
+				Path:    []string{"ignore event which is not an AlarmEvent"},
+			}},
+		},
+		{
+			name:     "invalid limit",
+			query:    "?limit=-1",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/events"+tt.query, nil)
+			a.adminHandler(ctx).ServeHTTP(rec, req)
+
+			assert.Equal(t, rec.Code, tt.wantCode)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var got []recentEvent
+			err := json.NewDecoder(rec.Body).Decode(&got)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, got, tt.want)
+		})
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
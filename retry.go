@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"knative.dev/pkg/logging"
+)
+
+// retryPolicy retries vCenter calls failing with retryable errors using
+// exponential backoff with jitter. The zero value performs a single attempt
+// without a deadline.
+type retryPolicy struct {
+	attempts   int           // max attempts including the first call, values < 2 disable retries
+	backoff    time.Duration // initial backoff, doubled after each attempt
+	maxBackoff time.Duration // upper bound for the backoff
+	timeout    time.Duration // per attempt deadline, 0 disables the deadline
+
+	// retryable classifies errors, nil uses isRetryable for vCenter calls
+	retryable func(error) bool
+}
+
+// do calls fn until it succeeds, returns a permanent error, the attempts are
+// exhausted or ctx is cancelled
+func (p retryPolicy) do(ctx context.Context, fn func(ctx context.Context) error) error {
+	attempts := p.attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			d := p.delay(i)
+			logging.FromContext(ctx).Debugw("retrying call", "attempt", i+1, "backoff", d.String(), "error", err)
+
+			t := time.NewTimer(d)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+			case <-t.C:
+			}
+		}
+
+		if err = p.attempt(ctx, fn); err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		}
+
+		retryable := p.retryable
+		if retryable == nil {
+			retryable = isRetryable
+		}
+		if !retryable(err) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+}
+
+func (p retryPolicy) attempt(ctx context.Context, fn func(ctx context.Context) error) error {
+	if p.timeout <= 0 {
+		return fn(ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+// delay returns the backoff before the specified retry (starting at 1) with
+// jitter in [backoff/2, backoff)
+func (p retryPolicy) delay(retry int) time.Duration {
+	d := p.backoff
+	for i := 1; i < retry && (p.maxBackoff <= 0 || d < p.maxBackoff); i++ {
+		d *= 2
+	}
+
+	if p.maxBackoff > 0 && d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+
+	if d <= 1 {
+		return d
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+// isRetryable returns whether the vCenter call failing with the specified error
+// may succeed when retried. vCenter faults are considered permanent unless
+// they signal a transient server or session condition.
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, errSessionLost) || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	// per attempt deadline
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	if fault, ok := vimFault(err); ok {
+		switch fault.(type) {
+		case types.NotAuthenticated, *types.NotAuthenticated,
+			types.SystemError, *types.SystemError,
+			types.HostCommunication, *types.HostCommunication,
+			types.RequestCanceled, *types.RequestCanceled,
+			types.TaskInProgress, *types.TaskInProgress:
+			return true
+		default:
+			// e.g. ManagedObjectNotFound, InvalidArgument, NoPermission
+			return false
+		}
+	}
+
+	// transport errors (connection refused/reset, timeouts) are retryable
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// vimFault returns the vCenter fault contained in the specified (wrapped)
+// error, if any
+func vimFault(err error) (interface{}, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		switch {
+		case soap.IsSoapFault(err):
+			return soap.ToSoapFault(err).VimFault(), true
+		case soap.IsVimFault(err):
+			// e.g. property collector MissingSet faults
+			return soap.ToVimFault(err), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func Test_retryPolicy_delay(t *testing.T) {
+	p := retryPolicy{
+		backoff:    time.Millisecond * 100,
+		maxBackoff: time.Millisecond * 500,
+	}
+
+	tests := []struct {
+		retry    int
+		min, max time.Duration
+	}{
+		{retry: 1, min: time.Millisecond * 50, max: time.Millisecond * 100},
+		{retry: 2, min: time.Millisecond * 100, max: time.Millisecond * 200},
+		{retry: 3, min: time.Millisecond * 200, max: time.Millisecond * 400},
+		{retry: 4, min: time.Millisecond * 250, max: time.Millisecond * 500},
+		{retry: 10, min: time.Millisecond * 250, max: time.Millisecond * 500},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			d := p.delay(tt.retry)
+			assert.Assert(t, d >= tt.min && d < tt.max, "retry %d: delay %v not in [%v,%v)", tt.retry, d, tt.min, tt.max)
+		}
+	}
+}
+
+// Test_alarmServer_retrieveAlarm_faults injects vCenter faults into the
+// property collector of vcsim
+func Test_alarmServer_retrieveAlarm_faults(t *testing.T) {
+	tests := []struct {
+		name      string
+		fault     types.BaseMethodFault
+		faults    int32 // number of calls failing with fault
+		delay     time.Duration
+		wantCalls int32
+		wantErr   bool
+	}{
+		{
+			name:      "no fault",
+			wantCalls: 1,
+			wantErr:   false,
+		},
+		{
+			name:      "transient fault recovers",
+			fault:     &types.SystemError{Reason: "injected"},
+			faults:    2,
+			wantCalls: 3,
+			wantErr:   false,
+		},
+		{
+			name:      "transient fault exhausts attempts",
+			fault:     &types.SystemError{Reason: "injected"},
+			faults:    5,
+			wantCalls: 3,
+			wantErr:   true,
+		},
+		{
+			name:      "permanent fault is not retried",
+			fault:     &types.ManagedObjectNotFound{Obj: types.ManagedObjectReference{Type: "Alarm", Value: "alarm-1"}},
+			faults:    5,
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "attempt exceeds deadline",
+			delay:     time.Millisecond * 200,
+			faults:    1,
+			wantCalls: 2,
+			wantErr:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			simulator.Test(func(ctx context.Context, client *vim25.Client) {
+				vc := simulatorClient(t, client, "alarm-1")
+				moref := createAlarm(t, "alarm-1").Info.Alarm
+
+				var calls int32
+				simulator.Map.Handler = func(_ *simulator.Context, m *simulator.Method) (mo.Reference, types.BaseMethodFault) {
+					if m.Name != "RetrieveProperties" && m.Name != "RetrievePropertiesEx" {
+						return nil, nil
+					}
+
+					n := atomic.AddInt32(&calls, 1)
+					if n > tt.faults {
+						return nil, nil
+					}
+
+					if tt.delay > 0 {
+						time.Sleep(tt.delay)
+					}
+					return nil, tt.fault
+				}
+				defer func() { simulator.Map.Handler = nil }()
+
+				a := &alarmServer{
+					session: newSession(vc, ""),
+					retry: retryPolicy{
+						attempts:   3,
+						backoff:    time.Millisecond,
+						maxBackoff: time.Millisecond * 10,
+						timeout:    time.Millisecond * 100,
+					},
+				}
+				ctx = logging.WithLogger(ctx, zaptest.NewLogger(t).Sugar())
+
+				got, err := a.retrieveAlarm(ctx, moref)
+				assert.Equal(t, atomic.LoadInt32(&calls), tt.wantCalls)
+				if tt.wantErr {
+					assert.Assert(t, err != nil)
+					return
+				}
+				assert.NilError(t, err)
+				assert.Equal(t, got.Info.Name, "alarm-1")
+			})
+		})
+	}
+}
+
+func Test_retryPolicy_do_cancelled(t *testing.T) {
+	p := retryPolicy{attempts: 5, backoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var calls int
+	err := p.do(ctx, func(ctx context.Context) error {
+		calls++
+		cancel()
+		return context.DeadlineExceeded // retryable
+	})
+	assert.Assert(t, errors.Is(err, context.Canceled), "error: %v", err)
+	assert.Equal(t, calls, 1)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cetypes "github.com/cloudevents/sdk-go/v2/types"
+	"github.com/google/cel-go/cel"
+	"github.com/vmware/govmomi/vim25/types"
+	"gopkg.in/yaml.v2"
+	"knative.dev/pkg/logging"
+)
+
+// variables available in rule conditions
+const (
+	ruleVarCloudEvent = "ce"    // CloudEvent attributes and extensions
+	ruleVarEvent      = "event" // decoded vSphere event
+	ruleVarAlarm      = "alarm" // AlarmInfo, available after the lookup
+)
+
+// ruleAction is the action taken for an event matching a rule
+type ruleAction string
+
+const (
+	ruleEnrich      ruleAction = "enrich"      // enrich the event with the alarm info
+	rulePassthrough ruleAction = "passthrough" // return the event without alarm info
+	ruleDrop        ruleAction = "drop"        // acknowledge and drop the event
+)
+
+// rulesConfig is the format of the rules file
+type rulesConfig struct {
+	Rules []struct {
+		Name      string     `yaml:"name"`
+		Condition string     `yaml:"condition"`
+		Action    ruleAction `yaml:"action"`
+	} `yaml:"rules"`
+}
+
+type rule struct {
+	name      string
+	condition *condition
+	action    ruleAction
+}
+
+// condition is a compiled CEL expression of a rule
+type condition struct {
+	program   cel.Program
+	usesAlarm bool // the expression references the alarm variable
+}
+
+// newRuleEnv returns the CEL environment of rule conditions
+func newRuleEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable(ruleVarCloudEvent, cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable(ruleVarEvent, cel.DynType),
+		cel.Variable(ruleVarAlarm, cel.DynType),
+	)
+}
+
+// compileCondition parses and type-checks the CEL expression which must
+// evaluate to a bool
+func compileCondition(env *cel.Env, source string) (*condition, error) {
+	ast, iss := env.Compile(source)
+	if iss.Err() != nil {
+		return nil, iss.Err()
+	}
+	if t := ast.OutputType(); !t.IsAssignableType(cel.BoolType) {
+		return nil, fmt.Errorf("condition must evaluate to bool, not %s", t)
+	}
+
+	checked, err := cel.AstToCheckedExpr(ast)
+	if err != nil {
+		return nil, err
+	}
+	var usesAlarm bool
+	for _, ref := range checked.GetReferenceMap() {
+		if ref.GetName() == ruleVarAlarm {
+			usesAlarm = true
+			break
+		}
+	}
+
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return &condition{program: program, usesAlarm: usesAlarm}, nil
+}
+
+// eval evaluates the condition with the variables
+func (c *condition) eval(vars map[string]interface{}) (bool, error) {
+	out, _, err := c.program.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("condition evaluated to %s, not bool", out.Type().TypeName())
+	}
+	return b, nil
+}
+
+// ruleSet decides which alarm events to enrich, pass through or drop. The
+// action of the first matching rule applies, events not matching any rule are
+// enriched. A nil rule set enriches all events.
+type ruleSet struct {
+	rules []rule
+}
+
+// loadRules reads and compiles the rules in the specified file
+func loadRules(path string) (*ruleSet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read rules file: %w", err)
+	}
+
+	var cfg rulesConfig
+	if err = yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("decode rules file: %w", err)
+	}
+	return compileRules(cfg)
+}
+
+func compileRules(cfg rulesConfig) (*ruleSet, error) {
+	env, err := newRuleEnv()
+	if err != nil {
+		return nil, fmt.Errorf("create rule environment: %w", err)
+	}
+
+	var rs ruleSet
+	names := map[string]bool{}
+	for i, r := range cfg.Rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule %d: name must not be empty", i+1)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("rule %q: duplicate name", r.Name)
+		}
+		names[r.Name] = true
+
+		switch r.Action {
+		case ruleEnrich, rulePassthrough, ruleDrop:
+		default:
+			return nil, fmt.Errorf("rule %q: invalid action %q: must be one of %q, %q or %q", r.Name, r.Action, ruleEnrich, rulePassthrough, ruleDrop)
+		}
+
+		if r.Condition == "" {
+			return nil, fmt.Errorf("rule %q: condition must not be empty", r.Name)
+		}
+		condition, err := compileCondition(env, r.Condition)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: compile condition %q: %w", r.Name, r.Condition, err)
+		}
+
+		rs.rules = append(rs.rules, rule{name: r.Name, condition: condition, action: r.Action})
+	}
+	return &rs, nil
+}
+
+// match returns the first rule matching the variables starting at the rule
+// with index from. If the variables do not contain the alarm, matching stops
+// before the first rule using the alarm and returns false with the index to
+// continue after the lookup. Rules which cannot be evaluated, e.g. because of
+// a missing field, do not match.
+func (rs *ruleSet) match(ctx context.Context, vars map[string]interface{}, from int) (*rule, int, bool) {
+	if rs == nil {
+		return nil, 0, true
+	}
+
+	_, haveAlarm := vars[ruleVarAlarm]
+	for i := from; i < len(rs.rules); i++ {
+		r := &rs.rules[i]
+		if !haveAlarm && r.condition.usesAlarm {
+			return nil, i, false
+		}
+
+		ok, err := r.condition.eval(vars)
+		if err != nil {
+			logging.FromContext(ctx).Warnw("could not evaluate rule", "rule", r.name, "error", err)
+			decisionFrom(ctx).step("evaluate rule %q: %v", r.name, err)
+			continue
+		}
+		if ok {
+			return r, i, true
+		}
+	}
+	return nil, len(rs.rules), true
+}
+
+// ruleVars returns the rule variables of the event
+func ruleVars(event cloudevents.Event) (map[string]interface{}, error) {
+	ce := map[string]interface{}{
+		"id":          event.ID(),
+		"source":      event.Source(),
+		"type":        event.Type(),
+		"specversion": event.SpecVersion(),
+	}
+	if s := event.Subject(); s != "" {
+		ce["subject"] = s
+	}
+	if t := event.Time(); !t.IsZero() {
+		ce["time"] = cetypes.FormatTime(t)
+	}
+	if ct := event.DataContentType(); ct != "" {
+		ce["datacontenttype"] = ct
+	}
+	for k, v := range event.Extensions() {
+		s, err := cetypes.Format(v)
+		if err != nil {
+			return nil, fmt.Errorf("format extension %q: %w", k, err)
+		}
+		ce[k] = s
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(event.Data(), &data); err != nil {
+		return nil, fmt.Errorf("decode event data: %w", err)
+	}
+
+	return map[string]interface{}{
+		ruleVarCloudEvent: ce,
+		ruleVarEvent:      data,
+	}, nil
+}
+
+// withAlarm adds the alarm info to the rule variables
+func withAlarm(vars map[string]interface{}, info types.AlarmInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("marshal AlarmInfo: %w", err)
+	}
+
+	var alarm interface{}
+	if err = json.Unmarshal(b, &alarm); err != nil {
+		return fmt.Errorf("decode AlarmInfo: %w", err)
+	}
+	vars[ruleVarAlarm] = alarm
+	return nil
+}
+
+// applyRule handles the event according to the action of the matching rule.
+// It returns false if the event should be enriched.
+func (a *alarmServer) applyRule(ctx context.Context, event cloudevents.Event, r *rule) (*cloudevents.Event, cloudevents.Result, bool) {
+	if r == nil {
+		return nil, nil, false
+	}
+
+	d := decisionFrom(ctx)
+	d.step("rule %q matched: %s", r.name, r.action)
+
+	logger := logging.FromContext(ctx).With("rule", r.name)
+	switch r.action {
+	case ruleDrop:
+		logger.Debugw("dropping event", "id", event.ID(), "source", event.Source(), "type", event.Type())
+		a.outcome(ctx, event, outcomeDropped, r.name)
+		return nil, nil, true
+	case rulePassthrough:
+		resp, err := a.newResponse(ctx, event, a.responseType(event), event.Data())
+		if err != nil {
+			logger.Errorf("set cloud event response data: %v", err)
+			resp, result := a.fail(ctx, event, failurePatch, err)
+			return resp, result, true
+		}
+		logger.Debugw("returning event without alarm info", "source", resp.Source(), "type", resp.Type())
+		if d != nil {
+			d.output = resp
+		}
+		a.outcome(ctx, event, outcomePassed, r.name)
+		return resp, nil, true
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func writeRules(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	err := os.WriteFile(path, []byte(content), 0644)
+	assert.NilError(t, err)
+	return path
+}
+
+func Test_loadRules(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		wantRules int
+		wantErr   string
+	}{
+		{
+			name: "valid rules",
+			content: `
+rules:
+  - name: drop-test-hosts
+    condition: event.Entity.Name.startsWith("test-")
+    action: drop
+  - name: pass-disabled
+    condition: '!alarm.Enabled'
+    action: passthrough
+`,
+			wantRules: 2,
+		},
+		{
+			name:      "no rules",
+			content:   `rules: []`,
+			wantRules: 0,
+		},
+		{
+			name:    "unknown key",
+			content: "rules:\n  - name: a\n    expression: true\n    action: drop\n",
+			wantErr: "decode rules file",
+		},
+		{
+			name:    "missing name",
+			content: "rules:\n  - condition: 'true'\n    action: drop\n",
+			wantErr: "rule 1: name must not be empty",
+		},
+		{
+			name:    "duplicate name",
+			content: "rules:\n  - name: a\n    condition: 'true'\n    action: drop\n  - name: a\n    condition: 'false'\n    action: drop\n",
+			wantErr: `rule "a": duplicate name`,
+		},
+		{
+			name:    "invalid action",
+			content: "rules:\n  - name: a\n    condition: 'true'\n    action: ignore\n",
+			wantErr: `rule "a": invalid action "ignore"`,
+		},
+		{
+			name:    "invalid condition",
+			content: "rules:\n  - name: a\n    condition: 'event.To = \"red\"'\n    action: drop\n",
+			wantErr: `rule "a": compile condition "event.To = \"red\"": ERROR: <input>:1:10: Syntax error: token recognition error at: '= '`,
+		},
+		{
+			name:    "not bool",
+			content: "rules:\n  - name: a\n    condition: 'ce.type'\n    action: drop\n",
+			wantErr: `rule "a": compile condition "ce.type": condition must evaluate to bool, not string`,
+		},
+		{
+			name:    "undeclared variable",
+			content: "rules:\n  - name: a\n    condition: 'vm.Name == \"x\"'\n    action: drop\n",
+			wantErr: `undeclared reference to 'vm'`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs, err := loadRules(writeRules(t, tt.content))
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, len(rs.rules), tt.wantRules)
+		})
+	}
+}
+
+func Test_compileCondition(t *testing.T) {
+	vars := map[string]interface{}{
+		ruleVarCloudEvent: map[string]interface{}{"type": "AlarmStatusChangedEvent", "subject": "host-1"},
+		ruleVarEvent: map[string]interface{}{
+			"Key":    float64(42),
+			"To":     "red",
+			"Entity": map[string]interface{}{"Name": "test-esx-01"},
+		},
+		ruleVarAlarm: map[string]interface{}{"Name": "Host CPU usage", "Enabled": true},
+	}
+
+	tests := []struct {
+		name          string
+		source        string
+		wantUsesAlarm bool
+		want          bool
+		wantErr       string
+	}{
+		{name: "attribute", source: `ce.type == "AlarmStatusChangedEvent"`, want: true},
+		{name: "nested field", source: `event.Entity.Name.startsWith("test-")`, want: true},
+		{name: "number", source: `event.Key == 42.0 && int(event.Key) % 2 == 0`, want: true},
+		{name: "has", source: `has(event.Vm) || event.To in ["yellow", "red"]`, want: true},
+		{name: "alarm", source: `alarm.Enabled && alarm.Name.matches("^Host ")`, wantUsesAlarm: true, want: true},
+		{name: "missing field", source: `event.Vm.Name == "vm-1"`, wantErr: "no such key: Vm"},
+		{name: "dyn not bool", source: `event.To`, wantErr: "condition evaluated to string, not bool"},
+	}
+	env, err := newRuleEnv()
+	assert.NilError(t, err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := compileCondition(env, tt.source)
+			assert.NilError(t, err)
+			assert.Equal(t, c.usesAlarm, tt.wantUsesAlarm)
+
+			got, err := c.eval(vars)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, got, tt.want)
+		})
+	}
+}
+
+func Test_alarmServer_handleEvent_rules(t *testing.T) {
+	tests := []struct {
+		name         string
+		rules        string
+		cached       bool // alarm is in the cache, otherwise the lookup fails
+		wantOutcome  string
+		wantReason   string
+		wantLookups  float64
+		wantType     string // empty if no response
+		wantEnriched bool
+	}{
+		{
+			name: "drop before lookup",
+			rules: `
+rules:
+  - name: drop-yellow
+    condition: event.To == "yellow" && ce.type == "AlarmStatusChangedEvent"
+    action: drop
+  - name: drop-alarm
+    condition: alarm.Name == "alarm-1"
+    action: passthrough
+`,
+			wantOutcome: outcomeDropped,
+			wantReason:  "drop-yellow",
+			wantLookups: 0,
+		},
+		{
+			name: "passthrough after lookup",
+			rules: `
+rules:
+  - name: drop-red
+    condition: event.To == "red"
+    action: drop
+  - name: pass-alarm-1
+    condition: alarm.Name == "alarm-1"
+    action: passthrough
+`,
+			cached:      true,
+			wantOutcome: outcomePassed,
+			wantReason:  "pass-alarm-1",
+			wantLookups: 1,
+			wantType:    "AlarmStatusChangedEvent." + suffix,
+		},
+		{
+			name: "enrich rule stops evaluation",
+			rules: `
+rules:
+  - name: enrich-yellow
+    condition: event.To == "yellow"
+    action: enrich
+  - name: drop-all
+    condition: "true"
+    action: drop
+`,
+			cached:       true,
+			wantOutcome:  outcomeEnriched,
+			wantLookups:  1,
+			wantType:     "AlarmStatusChangedEvent." + suffix,
+			wantEnriched: true,
+		},
+		{
+			name: "no match enriches",
+			rules: `
+rules:
+  - name: drop-red
+    condition: event.To == "red"
+    action: drop
+  - name: drop-other-alarm
+    condition: alarm.Name == "alarm-2"
+    action: drop
+`,
+			cached:       true,
+			wantOutcome:  outcomeEnriched,
+			wantLookups:  1,
+			wantType:     "AlarmStatusChangedEvent." + suffix,
+			wantEnriched: true,
+		},
+		{
+			name: "evaluation error does not match",
+			rules: `
+rules:
+  - name: drop-vm
+    condition: event.Vm.Name == "vm-1"
+    action: drop
+`,
+			cached:       true,
+			wantOutcome:  outcomeEnriched,
+			wantLookups:  1,
+			wantType:     "AlarmStatusChangedEvent." + suffix,
+			wantEnriched: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testEvents := createCloudEvents(t)
+			rs, err := loadRules(writeRules(t, tt.rules))
+			assert.NilError(t, err)
+
+			c := newAlarmCache(3600)
+			if tt.cached {
+				c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+			}
+
+			a := &alarmServer{
+				session:   newSession(nil, ""),
+				cache:     c,
+				clock:     clock.NewMock(),
+				source:    vc,
+				suffix:    "." + suffix,
+				injectKey: injectKey,
+				metrics:   newMetrics(),
+				rules:     rs,
+			}
+			ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+			event := *testEvents["AlarmStatusChangedEvent"]
+			resp, result := a.handleEvent(ctx, event)
+			assert.NilError(t, result)
+
+			assert.Equal(t, a.metrics.events.get(tt.wantOutcome, tt.wantReason), float64(1))
+			assert.Equal(t, a.metrics.cacheHits.get()+a.metrics.cacheMisses.get(), tt.wantLookups)
+
+			if tt.wantType == "" {
+				assert.Assert(t, resp == nil)
+				return
+			}
+			assert.Equal(t, resp.Type(), tt.wantType)
+
+			var data map[string]interface{}
+			assert.NilError(t, json.Unmarshal(resp.Data(), &data))
+			_, enriched := data[injectKey]
+			assert.Equal(t, enriched, tt.wantEnriched)
+		})
+	}
+}
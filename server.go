@@ -3,44 +3,207 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/benbjohnson/clock"
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	"github.com/cloudevents/sdk-go/v2/client"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
 	vsphere "github.com/embano1/vsphere/client"
 	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/google/uuid"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/property"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 	"knative.dev/pkg/logging"
 )
 
 const (
 	envPrefix = ""
+
+	// enrichmentErrorExtension is the CloudEvents extension attribute holding
+	// the reason why an event was returned without alarm info
+	enrichmentErrorExtension = "enrichmenterror"
+
+	// extension attributes referencing the received event
+	originalIDExtension     = "originalid"
+	originalTypeExtension   = "originaltype"
+	originalSourceExtension = "originalsource"
 )
 
+// idNamespace is the UUID namespace of deterministic response IDs
+var idNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/embano1/vsphere-alarm-server"))
+
 type envConfig struct {
 	vsphere.Config
 	Port        int    `envconfig:"PORT" default:"8080" required:"true"`
+	AdminPort   int    `envconfig:"ADMIN_PORT" default:"8081"`
+	AdminHost   string `envconfig:"ADMIN_HOST" default:"127.0.0.1"` // the admin endpoints are not authenticated
+	HealthPort  int    `envconfig:"HEALTH_PORT" default:"8082"`
+	MetricsPort int    `envconfig:"METRICS_PORT" default:"9090"`
 	TTL         int64  `envconfig:"CACHE_TTL" default:"3600"`
 	Debug       bool   `envconfig:"DEBUG" default:"false"`
 	EventSuffix string `envconfig:"EVENT_SUFFIX" default:"" required:"true"`
 	InjectKey   string `envconfig:"ALARM_KEY" default:"" required:"true"`
+
+	// vCenter retrieval retries
+	RetryAttempts   int           `envconfig:"RETRY_ATTEMPTS" default:"3"`
+	RetryBackoff    time.Duration `envconfig:"RETRY_BACKOFF" default:"200ms"`
+	RetryMaxBackoff time.Duration `envconfig:"RETRY_MAX_BACKOFF" default:"5s"`
+	RetryTimeout    time.Duration `envconfig:"RETRY_TIMEOUT" default:"10s"`
+
+	// vCenter circuit breaker
+	BreakerThreshold int           `envconfig:"BREAKER_THRESHOLD" default:"5"`
+	BreakerCooldown  time.Duration `envconfig:"BREAKER_COOLDOWN" default:"30s"`
+	DegradedSuffix   string        `envconfig:"DEGRADED_SUFFIX" default:"Degraded"`
+
+	// action per failure class: ack, passthrough or nack
+	DecodeFailurePolicy  string `envconfig:"DECODE_FAILURE_POLICY" default:"ack"`
+	VCenterFailurePolicy string `envconfig:"VCENTER_FAILURE_POLICY" default:"passthrough"`
+	PatchFailurePolicy   string `envconfig:"PATCH_FAILURE_POLICY" default:"ack"`
+	SinkFailurePolicy    string `envconfig:"SINK_FAILURE_POLICY" default:"nack"` // ack or nack
+
+	// sinks for returned events instead of replying, K_SINK is injected by a
+	// Knative SinkBinding
+	Sink                string        `envconfig:"K_SINK" default:""`
+	Sinks               []string      `envconfig:"SINKS" default:""` // comma-separated
+	SinkRetryAttempts   int           `envconfig:"SINK_RETRY_ATTEMPTS" default:"3"`
+	SinkRetryBackoff    time.Duration `envconfig:"SINK_RETRY_BACKOFF" default:"200ms"`
+	SinkRetryMaxBackoff time.Duration `envconfig:"SINK_RETRY_MAX_BACKOFF" default:"5s"`
+	SinkTimeout         time.Duration `envconfig:"SINK_TIMEOUT" default:"10s"`
+	SinkTimeouts        []string      `envconfig:"SINK_TIMEOUTS" default:""` // comma-separated <sink>=<timeout>
+
+	// dead-letter sink for events which could not be enriched
+	DeadLetterSink string `envconfig:"DEADLETTER_SINK" default:""`
+	DeadLetterFile string `envconfig:"DEADLETTER_FILE" default:""`
+
+	// max time to wait for in-flight events on shutdown
+	DrainTimeout time.Duration `envconfig:"DRAIN_TIMEOUT" default:"20s"`
+	// max time to release held events on shutdown after draining
+	FlushTimeout time.Duration `envconfig:"FLUSH_TIMEOUT" default:"5s"`
+
+	// concurrency limit and backpressure
+	MaxInFlight int           `envconfig:"MAX_IN_FLIGHT" default:"50"`
+	QueueSize   int           `envconfig:"QUEUE_SIZE" default:"100"`
+	RetryAfter  time.Duration `envconfig:"RETRY_AFTER" default:"5s"`
+
+	// poll interval for rotated credentials in the secret
+	CredentialsPollInterval time.Duration `envconfig:"CREDENTIALS_POLL_INTERVAL" default:"10s"`
+
+	// derive response IDs from the received event instead of random UUIDs
+	DeterministicIDs bool `envconfig:"DETERMINISTIC_IDS" default:"false"`
+
+	// time attribute of returned events: now, created or original
+	EventTime          string        `envconfig:"EVENT_TIME" default:"now"`
+	ProcessedTime      bool          `envconfig:"PROCESSED_TIME" default:"false"`
+	ClockSkewThreshold time.Duration `envconfig:"CLOCK_SKEW_THRESHOLD" default:"5m"`
+
+	// runtime log level and audit log
+	LogLevelFile       string `envconfig:"LOG_LEVEL_FILE" default:""`
+	AuditLog           string `envconfig:"AUDIT_LOG" default:""`
+	AuditLogMaxSize    int    `envconfig:"AUDIT_LOG_MAX_SIZE" default:"100"` // megabytes
+	AuditLogMaxBackups int    `envconfig:"AUDIT_LOG_MAX_BACKUPS" default:"3"`
+
+	// recently processed events exposed on the admin server
+	RecentEvents      int `envconfig:"RECENT_EVENTS" default:"100"`
+	RecentPayloadSize int `envconfig:"RECENT_EVENTS_PAYLOAD_SIZE" default:"2048"` // bytes
+
+	// OTLP/HTTP traces endpoint, empty disables tracing
+	OTLPTracesEndpoint string `envconfig:"OTLP_TRACES_ENDPOINT" default:""`
+
+	// filter rules
+	RulesFile string `envconfig:"RULES_FILE" default:""`
+
+	// event types derived from alarm transitions
+	EventTypeMode        string `envconfig:"EVENT_TYPE_MODE" default:"suffix"`
+	EventTypePrefix      string `envconfig:"EVENT_TYPE_PREFIX" default:"com.vmware.vsphere"`
+	EventTypeMappingFile string `envconfig:"EVENT_TYPE_MAPPING_FILE" default:""`
+
+	// deduplication of repeated alarm events
+	DedupWindow       time.Duration `envconfig:"DEDUP_WINDOW" default:"0"` // 0 disables deduplication
+	DedupByTransition bool          `envconfig:"DEDUP_BY_TRANSITION" default:"false"`
+	DedupMaxEvents    int           `envconfig:"DEDUP_MAX_EVENTS" default:"10000"`
+
+	// debounce of alarm transitions
+	DebounceDelay    time.Duration `envconfig:"DEBOUNCE_DELAY" default:"0"` // 0 disables debouncing
+	DebounceStatuses []string      `envconfig:"DEBOUNCE_STATUSES" default:"green"`
+
+	// digests of alarm events per group
+	DigestWindow      time.Duration `envconfig:"DIGEST_WINDOW" default:"0"` // 0 disables digests
+	DigestGroupBy     string        `envconfig:"DIGEST_GROUP_BY" default:"computeresource"`
+	DigestIndividual  bool          `envconfig:"DIGEST_INDIVIDUAL" default:"true"`
+	DigestMaxEntities int           `envconfig:"DIGEST_MAX_ENTITIES" default:"100"`
+
+	// flapping alarms
+	FlapWindow    time.Duration `envconfig:"FLAP_WINDOW" default:"1h"` // 0 disables tracking
+	FlapThreshold int           `envconfig:"FLAP_THRESHOLD" default:"10"`
+	FlapMaxAlarms int           `envconfig:"FLAP_MAX_ALARMS" default:"1000"`
+
+	// heartbeat and lifecycle events
+	StatusSink        string        `envconfig:"STATUS_SINK" default:""`
+	HeartbeatInterval time.Duration `envconfig:"HEARTBEAT_INTERVAL" default:"1m"`
 }
 
 type alarmServer struct {
-	vcClient  *govmomi.Client
-	ceClient  client.Client
-	cache     *cache
-	errCh     chan error
-	source    string
-	suffix    string
-	injectKey string
+	session             *session
+	newClient           func(ctx context.Context) (*govmomi.Client, error)
+	ceClient            client.Client
+	cache               *cache
+	errCh               chan error
+	source              string
+	suffix              string
+	types               *typeMapper // nil appends the suffix to the received type
+	injectKey           string
+	adminHost           string
+	adminPort           int
+	healthPort          int
+	retry               retryPolicy
+	breaker             *breaker
+	degraded            string // type suffix of events which could not be enriched
+	policy              failurePolicy
+	deadLetters         deadLetterSink
+	sinks               *sinks
+	inflight            *inflight
+	drainTimeout        time.Duration
+	flushTimeout        time.Duration
+	limiter             *limiter
+	probe               *sessionProbe
+	credentialsInterval time.Duration // poll interval for rotated credentials
+	metrics             *metrics
+	metricsPort         int
+	deterministicIDs    bool // derive response IDs from the received event
+	clock               clock.Clock
+	timeMode            eventTimeMode
+	processedTime       bool // add the processing time extension
+	skewThreshold       time.Duration
+	logLevel            *zap.AtomicLevel // nil if the level cannot be changed
+	logLevelFile        string
+	auditLog            *zap.SugaredLogger
+	auditFile           *rotatingFile
+	tracer              trace.Tracer             // nil disables tracing
+	tracerProvider      *sdktrace.TracerProvider // nil if tracing is disabled
+	recent              *recentEvents
+	rules               *ruleSet
+	flaps               *flapTracker
+	dedup               *deduplicator
+	debounce            *debouncer
+	digests             *digester
+	status              *statusEmitter
+	heartbeatInterval   time.Duration
+	started             time.Time
+	receiving           int32 // 1 while the event receiver is running
 }
 
 func newAlarmServer(ctx context.Context) (*alarmServer, error) {
@@ -53,12 +216,22 @@ func newAlarmServer(ctx context.Context) (*alarmServer, error) {
 		return nil, err
 	}
 
-	vc, err := vsphere.New(ctx)
+	source, err := soap.ParseURL(env.Address)
 	if err != nil {
-		return nil, fmt.Errorf("create vsphere client: %w", err)
+		return nil, fmt.Errorf("parse VCENTER_URL: %w", err)
 	}
+	source.User = nil
 
-	p, err := cloudevents.NewHTTP(cloudevents.WithPort(env.Port))
+	var l *limiter
+	if env.MaxInFlight > 0 {
+		l = newLimiter(env.MaxInFlight, env.QueueSize, env.RetryAfter)
+	}
+
+	p, err := cloudevents.NewHTTP(
+		cloudevents.WithPort(env.Port),
+		cehttp.WithShutdownTimeout(env.DrainTimeout),
+		cehttp.WithMiddleware(l.middleware),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("create cloudevents transport: %w", err)
 	}
@@ -68,33 +241,229 @@ func newAlarmServer(ctx context.Context) (*alarmServer, error) {
 		return nil, fmt.Errorf("create cloudevents client, %w", err)
 	}
 
+	policy, err := newFailurePolicy(env)
+	if err != nil {
+		return nil, err
+	}
+
+	timeMode, err := parseEventTimeMode(env.EventTime)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		auditLog  *zap.SugaredLogger
+		auditFile *rotatingFile
+	)
+	if env.AuditLog != "" {
+		auditLog, auditFile, err = newAuditLogger(env.AuditLog, int64(env.AuditLogMaxSize)*1024*1024, env.AuditLogMaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("create audit log: %w", err)
+		}
+	}
+
+	dl, err := newDeadLetterSink(env.DeadLetterSink, env.DeadLetterFile)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := logging.FromContext(ctx)
+	var b *breaker
+	if env.BreakerThreshold > 0 {
+		b = newBreaker(env.BreakerThreshold, env.BreakerCooldown, func(from, to breakerState) {
+			logger.Warnw("vcenter circuit breaker state changed", "from", from, "to", to)
+		})
+	}
+
+	c := newAlarmCache(env.TTL)
+	// serve stale alarms from the cache while vcenter is unavailable
+	c.retain = func() bool {
+		return b.status().State != breakerClosed
+	}
+
+	var rules *ruleSet
+	if env.RulesFile != "" {
+		if rules, err = loadRules(env.RulesFile); err != nil {
+			return nil, fmt.Errorf("load rules: %w", err)
+		}
+	}
+
+	tm, err := newTypeMapper(typeMode(env.EventTypeMode), env.EventTypePrefix, env.EventTypeMappingFile)
+	if err != nil {
+		return nil, fmt.Errorf("load event type mappings: %w", err)
+	}
+
+	var flaps *flapTracker
+	if env.FlapWindow > 0 {
+		flaps = newFlapTracker(env.FlapWindow, env.FlapThreshold, env.FlapMaxAlarms)
+	}
+
+	var dedup *deduplicator
+	if env.DedupWindow > 0 {
+		dedup = newDeduplicator(env.DedupWindow, env.DedupMaxEvents, env.DedupByTransition)
+	}
+
+	var debounce *debouncer
+	if env.DebounceDelay > 0 {
+		debounce = newDebouncer(env.DebounceDelay, env.DebounceStatuses)
+	}
+
+	var digests *digester
+	if env.DigestWindow > 0 {
+		groupBy, err := parseDigestGroupBy(env.DigestGroupBy)
+		if err != nil {
+			return nil, err
+		}
+		digests = newDigester(env.DigestWindow, groupBy, env.DigestMaxEntities, env.DigestIndividual, env.EventTypePrefix+".alarm.digest")
+	}
+
+	var status *statusEmitter
+	if env.StatusSink != "" {
+		if status, err = newStatusEmitter(env.StatusSink, source.String()); err != nil {
+			return nil, err
+		}
+	}
+
+	sinkTimeouts, err := parseSinkTimeouts(env.SinkTimeouts)
+	if err != nil {
+		return nil, err
+	}
+
+	m := newMetrics()
+	sk, err := newSinks(append([]string{env.Sink}, env.Sinks...), sinkTimeouts, retryPolicy{
+		attempts:   env.SinkRetryAttempts,
+		backoff:    env.SinkRetryBackoff,
+		maxBackoff: env.SinkRetryMaxBackoff,
+		timeout:    env.SinkTimeout,
+	}, m)
+	if err != nil {
+		return nil, err
+	}
+
+	var tp *sdktrace.TracerProvider
+	if env.OTLPTracesEndpoint != "" {
+		if tp, err = newTracerProvider(ctx, env.OTLPTracesEndpoint); err != nil {
+			return nil, err
+		}
+	}
+
+	s := newSession(nil, env.SecretPath)
+	s.metrics = m
+	s.status = status
+
 	a := alarmServer{
-		vcClient:  vc.SOAP,
-		ceClient:  ce,
-		cache:     newAlarmCache(env.TTL),
-		errCh:     make(chan error, 1), // any error received will lead to termination
-		source:    vc.SOAP.URL().String(),
-		suffix:    fmt.Sprintf(".%s", env.EventSuffix),
-		injectKey: env.InjectKey,
+		session:    s,
+		newClient:  vsphere.NewSOAP,
+		probe:      newSessionProbe(sessionCheckInterval),
+		ceClient:   ce,
+		cache:      c,
+		errCh:      make(chan error, 1), // any error received will lead to termination
+		source:     source.String(),
+		suffix:     fmt.Sprintf(".%s", env.EventSuffix),
+		types:      tm,
+		injectKey:  env.InjectKey,
+		adminHost:  env.AdminHost,
+		adminPort:  env.AdminPort,
+		healthPort: env.HealthPort,
+		retry: retryPolicy{
+			attempts:   env.RetryAttempts,
+			backoff:    env.RetryBackoff,
+			maxBackoff: env.RetryMaxBackoff,
+			timeout:    env.RetryTimeout,
+		},
+		breaker:             b,
+		degraded:            fmt.Sprintf(".%s", env.DegradedSuffix),
+		policy:              policy,
+		deadLetters:         dl,
+		sinks:               sk,
+		inflight:            newInflight(),
+		drainTimeout:        env.DrainTimeout,
+		flushTimeout:        env.FlushTimeout,
+		credentialsInterval: env.CredentialsPollInterval,
+		metrics:             m,
+		metricsPort:         env.MetricsPort,
+		deterministicIDs:    env.DeterministicIDs,
+		clock:               clock.New(),
+		timeMode:            timeMode,
+		processedTime:       env.ProcessedTime,
+		skewThreshold:       env.ClockSkewThreshold,
+		logLevel:            logLevelFromContext(ctx),
+		logLevelFile:        env.LogLevelFile,
+		auditLog:            auditLog,
+		auditFile:           auditFile,
+		tracerProvider:      tp,
+		recent:              newRecentEvents(env.RecentEvents, env.RecentPayloadSize),
+		rules:               rules,
+		flaps:               flaps,
+		dedup:               dedup,
+		debounce:            debounce,
+		digests:             digests,
+		status:              status,
+		heartbeatInterval:   env.HeartbeatInterval,
+		limiter:             l,
+	}
+	if tp != nil {
+		a.tracer = tp.Tracer(tracerName)
+	}
+	if debounce != nil {
+		debounce.release = a.release
+	}
+	if digests != nil {
+		digests.emit = a.emitDigest
 	}
 
 	return &a, nil
 }
 
 func (a *alarmServer) run(ctx context.Context) error {
+	a.started = a.now()
 	eg, egCtx := errgroup.WithContext(ctx)
 
+	// in-flight events are not cancelled on shutdown but after draining
+	handlerCtx, cancelHandlers := context.WithCancel(context.Background())
+	defer cancelHandlers()
+
 	eg.Go(func() error {
-		return a.ceClient.StartReceiver(egCtx, a.handleEvent)
+		atomic.StoreInt32(&a.receiving, 1)
+		defer atomic.StoreInt32(&a.receiving, 0)
+		return a.ceClient.StartReceiver(egCtx, a.receiver(handlerCtx))
 	})
 
 	eg.Go(func() error {
 		return a.cache.run(egCtx)
 	})
 
+	eg.Go(func() error {
+		return a.connect(egCtx)
+	})
+
+	eg.Go(func() error {
+		return a.watchCredentials(egCtx)
+	})
+
+	eg.Go(func() error {
+		return a.watchLogLevel(egCtx)
+	})
+
+	eg.Go(func() error {
+		return a.runStatus(egCtx)
+	})
+
+	eg.Go(func() error {
+		return a.runAdmin(egCtx)
+	})
+
+	eg.Go(func() error {
+		return a.runHealth(egCtx)
+	})
+
+	eg.Go(func() error {
+		return a.runMetrics(egCtx)
+	})
+
 	eg.Go(func() error {
 		<-egCtx.Done()
-		_ = a.vcClient.Logout(context.TODO())
+		a.shutdown(ctx, cancelHandlers)
 		return nil
 	})
 
@@ -110,79 +479,327 @@ func (a *alarmServer) run(ctx context.Context) error {
 	return eg.Wait()
 }
 
-func (a *alarmServer) handleEvent(ctx context.Context, event cloudevents.Event) *cloudevents.Event {
+func (a *alarmServer) handleEvent(ctx context.Context, event cloudevents.Event) (*cloudevents.Event, cloudevents.Result) {
+	d := &decision{start: a.now()}
+	ctx = withDecision(ctx, d)
+	defer a.record(event, d)
+
+	ctx, span := a.startSpan(extractTrace(ctx, event), "handle event",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("cloudevents.event_id", event.ID()),
+			attribute.String("cloudevents.event_source", event.Source()),
+			attribute.String("cloudevents.event_type", event.Type()),
+		),
+	)
+	if sc := span.SpanContext(); sc.IsValid() {
+		ctx = logging.WithLogger(ctx, logging.FromContext(ctx).With("trace_id", sc.TraceID().String()))
+	}
+
+	resp, result := a.process(ctx, event)
+	if resp != nil && a.sinks != nil {
+		// sent to the sinks instead of replying
+		resp, result = nil, a.dispatch(ctx, event, resp)
+	}
+	span.SetAttributes(attribute.String("outcome", d.outcome), attribute.String("reason", d.reason))
+	endSpan(span, result)
+
+	// rejected events are redelivered and must not be ignored as duplicate
+	if result != nil {
+		a.dedup.forget(d.dedupKeys)
+	}
+	return resp, result
+}
+
+// process returns the response for the received event
+func (a *alarmServer) process(ctx context.Context, event cloudevents.Event) (*cloudevents.Event, cloudevents.Result) {
+	d := decisionFrom(ctx)
 	logger := logging.FromContext(ctx)
 
-	if event.Source() == a.source && strings.Contains(event.Type(), a.suffix) {
+	if event.Source() == a.source && (strings.Contains(event.Type(), a.suffix) || a.types.own(event.Type()) || a.digests.own(event.Type())) {
 		logger.Debugw("ignoring own event", "id", event.ID(), "source", event.Source(), "type", event.Type())
-		return nil
+		d.step("ignore own event")
+		a.outcome(ctx, event, outcomeIgnored, reasonSelf)
+		return nil, nil
 	}
 
 	// TODO: only JSON-encoded payload supported
 	if event.DataContentType() != cloudevents.ApplicationJSON {
 		logger.Debugw("ignoring event: payload is not JSON-encoded", "id", event.ID(), "source", event.Source(), "type", event.Type(), "encoding", event.DataContentType())
-		return nil
+		d.step("ignore event with content type %q", event.DataContentType())
+		a.outcome(ctx, event, outcomeIgnored, reasonNotJSON)
+		return nil, nil
 	}
 
 	// marshal into generic AlarmEvent to retrieve the moRef (works for all
 	// sub-classes of AlarmEvent)
 	var alarmEvent types.AlarmEvent
-	if err := event.DataAs(&alarmEvent); err != nil {
-		logger.Warnw("decode vcenter event: %v", err)
-		return nil
+	_, span := a.startSpan(ctx, "decode event")
+	err := event.DataAs(&alarmEvent)
+	endSpan(span, err)
+	if err != nil {
+		logger.Warnf("decode vcenter event: %v", err)
+		d.step("decode vcenter event: %v", err)
+		return a.fail(ctx, event, failureDecode, err)
 	}
 
 	// additional check to verify it's an alarm event because decoding above might
 	// succeed even in case of non alarm event due to embedded Event object
 	if moref := alarmEvent.Alarm.Alarm; moref.Type != "" {
 		logger.Infow("got alarm event", "source", a.source, "type", event.Type(), "moref", moref.String())
+		var (
+			transitions int
+			flapping    bool
+		)
+		if h, released := heldFrom(ctx); released {
+			// checked and recorded when the held event was received
+			transitions, flapping = h.transitions, h.flapping
+		} else {
+			if key, dup := a.duplicate(ctx, event); dup {
+				logger.Debugw("ignoring duplicate event", "id", event.ID(), "key", key)
+				d.step("ignore duplicate of %s", key)
+				a.outcome(ctx, event, outcomeIgnored, reasonDuplicate)
+				return nil, nil
+			}
+
+			a.checkSkew(ctx, alarmEvent.CreatedTime)
+			transitions, flapping = a.recordTransition(ctx, event)
+			if a.hold(ctx, event, heldTransition{transitions: transitions, flapping: flapping, dedupKeys: d.dedupKeys}) {
+				return nil, nil
+			}
+		}
+
+		// rules not using the alarm are evaluated before the lookup to avoid
+		// unnecessary vCenter calls
+		var (
+			vars map[string]interface{}
+			next int // first rule to evaluate after the lookup
+		)
+		if a.rules != nil {
+			var err error
+			if vars, err = ruleVars(event); err != nil {
+				logger.Warnf("decode rule variables: %v", err)
+				d.step("decode rule variables: %v", err)
+				return a.fail(ctx, event, failureDecode, err)
+			}
+
+			r, i, decided := a.rules.match(ctx, vars, 0)
+			if decided {
+				if resp, result, done := a.applyRule(ctx, event, r); done {
+					return resp, result
+				}
+				vars = nil
+			}
+			next = i
+		}
 
 		var (
 			alarm mo.Alarm
 			found bool
 		)
 
-		if alarm, found = a.cache.get(moref.String()); !found {
-			pc := property.DefaultCollector(a.vcClient.Client)
-			if err := pc.RetrieveOne(ctx, moref, nil, &alarm); err != nil {
-				if isNotAuthenticated(err) {
-					// TODO: easy way terminate and restart
-					a.errCh <- fmt.Errorf("vsphere session not authenticated: %w", err)
-					return nil
+		_, span = a.startSpan(ctx, "look up alarm in cache", trace.WithAttributes(attribute.String("vsphere.alarm", moref.String())))
+		alarm, found = a.cache.get(moref.String())
+		span.SetAttributes(attribute.Bool("cache.hit", found))
+		span.End()
+		a.metrics.cacheLookup(found)
+		d.moref, d.cacheHit = moref.String(), found
+		d.step("look up %s in cache: found=%t", moref.String(), found)
+		if !found {
+			var err error
+			if alarm, err = a.retrieveAlarm(ctx, moref); err != nil {
+				if errors.Is(err, errBreakerOpen) {
+					logger.Warnw("vcenter unavailable", "moref", moref.String(), "error", err)
+					d.step("retrieve alarm from vcenter: %v", err)
+					return a.fail(ctx, event, failureVCenter, err)
+				}
+
+				if errors.Is(err, errSessionLost) {
+					// unrecoverable, terminate and let kubernetes restart the server
+					select {
+					case a.errCh <- err:
+					default:
+					}
 				}
 				logger.Errorf("retrieve alarm from vcenter: %v", err)
-				return nil
+				d.step("retrieve alarm from vcenter: %v", err)
+				return a.fail(ctx, event, failureVCenter, err)
 			}
 			logger.Debugf("retrieved alarm details from vcenter: %v", alarm.Info)
 			logger.Debugf("adding %s to cache", moref.String())
+			d.step("retrieve alarm from vcenter and add to cache")
 			a.cache.add(moref.String(), alarm)
 		} else {
 			logger.Debugf("retrieved alarm details from cache: %v", alarm.Info)
 		}
 
-		resp := cloudevents.NewEvent()
-		resp.SetSource(a.source)
-		resp.SetType(event.Type() + a.suffix)
-		// return subject (if any) as is
-		resp.SetSubject(event.Subject())
+		d.alarm = alarm.Info.Name
+		if vars != nil {
+			if err := withAlarm(vars, alarm.Info); err != nil {
+				logger.Errorf("add alarm info to rule variables: %v", err)
+				d.step("add alarm info to rule variables: %v", err)
+				return a.fail(ctx, event, failurePatch, err)
+			}
+
+			r, _, _ := a.rules.match(ctx, vars, next)
+			if resp, result, done := a.applyRule(ctx, event, r); done {
+				return resp, result
+			}
+		}
 
+		_, span = a.startSpan(ctx, "patch event")
 		patched, err := injectAlarmInfo(event, a.injectKey, alarm.Info)
 		if err != nil {
+			endSpan(span, err)
 			logger.Errorf("inject info into event data: %v", err)
-			return nil
+			d.step("inject alarm info: %v", err)
+			return a.fail(ctx, event, failurePatch, err)
+		}
+
+		if flapping {
+			if patched, err = injectFlapping(patched, transitions); err != nil {
+				endSpan(span, err)
+				logger.Errorf("inject flapping into event data: %v", err)
+				d.step("inject flapping: %v", err)
+				return a.fail(ctx, event, failurePatch, err)
+			}
 		}
+		span.End()
 
-		err = resp.SetData(cloudevents.ApplicationJSON, patched)
+		resp, err := a.newResponse(ctx, event, a.responseType(event), patched)
 		if err != nil {
 			logger.Errorf("set cloud event response data: %v", err)
-			return nil
+			d.step("set response data: %v", err)
+			return a.fail(ctx, event, failurePatch, err)
 		}
 		logger.Debugw("returning enriched alarm event", "source", resp.Source(), "type", resp.Type())
-		return &resp
+		d.step("return enriched event")
+		d.output = resp
+		a.outcome(ctx, event, outcomeEnriched, "")
+		return resp, nil
 	}
 
 	logger.Debugf("ignoring event: not an AlarmEvent: %s", string(event.Data()))
-	return nil
+	d.step("ignore event which is not an AlarmEvent")
+	a.outcome(ctx, event, outcomeIgnored, reasonNotAlarm)
+	return nil, nil
+}
+
+// newResponse returns a response event for the specified incoming event with
+// the given type and JSON-encoded data, continuing the trace in ctx
+func (a *alarmServer) newResponse(ctx context.Context, event cloudevents.Event, eventType string, data []byte) (*cloudevents.Event, error) {
+	resp := cloudevents.NewEvent()
+	resp.SetSource(a.source)
+	resp.SetType(eventType)
+	// return subject (if any) as is
+	resp.SetSubject(event.Subject())
+	propagateTrace(ctx, &resp)
+
+	resp.SetExtension(originalIDExtension, event.ID())
+	resp.SetExtension(originalTypeExtension, event.Type())
+	resp.SetExtension(originalSourceExtension, event.Source())
+
+	// otherwise the client sets a random UUID
+	if a.deterministicIDs {
+		resp.SetID(responseID(event, eventType))
+	}
+
+	// otherwise the client sets the current time
+	if t := a.eventTime(event); !t.IsZero() {
+		resp.SetTime(t)
+	}
+
+	if a.processedTime {
+		resp.SetExtension(processedTimeExtension, a.now().UTC())
+	}
+
+	if err := resp.SetData(cloudevents.ApplicationJSON, data); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// responseID returns a name-based (SHA-1) UUID of the received event and the
+// response type so that redelivered events result in the same response ID.
+// Source and ID uniquely identify an event as per the CloudEvents
+// specification.
+func responseID(event cloudevents.Event, eventType string) string {
+	name := strings.Join([]string{event.Source(), event.ID(), eventType}, "\x00")
+	return uuid.NewSHA1(idNamespace, []byte(name)).String()
+}
+
+// degradedEvent returns the specified event without alarm info using the
+// degraded type suffix and the reason as enrichmenterror extension
+func (a *alarmServer) degradedEvent(ctx context.Context, event cloudevents.Event, reason error) *cloudevents.Event {
+	logger := logging.FromContext(ctx)
+
+	resp, err := a.newResponse(ctx, event, a.responseType(event)+a.degraded, event.Data())
+	if err != nil {
+		logger.Errorf("set cloud event response data: %v", err)
+		return nil
+	}
+	resp.SetExtension(enrichmentErrorExtension, reason.Error())
+
+	logger.Debugw("returning degraded alarm event", "source", resp.Source(), "type", resp.Type())
+	return resp
+}
+
+// retrieveAlarm retrieves the alarm identified by the specified moref from
+// vCenter, retrying transient failures according to the retry policy. Calls
+// are rejected with errBreakerOpen while the circuit breaker is open.
+func (a *alarmServer) retrieveAlarm(ctx context.Context, moref types.ManagedObjectReference) (mo.Alarm, error) {
+	if !a.breaker.allow() {
+		return mo.Alarm{}, errBreakerOpen
+	}
+
+	start := time.Now()
+	var alarm mo.Alarm
+	err := a.retry.do(ctx, func(ctx context.Context) error {
+		var err error
+		alarm, err = a.retrieveAlarmAuthenticated(ctx, moref)
+		return err
+	})
+	a.metrics.observeRetrieval(time.Since(start))
+	a.breaker.record(err)
+	return alarm, err
+}
+
+// retrieveAlarmAuthenticated retrieves the alarm identified by the specified
+// moref from vCenter. If the vCenter session is not authenticated, the session
+// is renewed and the retrieval is retried once.
+func (a *alarmServer) retrieveAlarmAuthenticated(ctx context.Context, moref types.ManagedObjectReference) (mo.Alarm, error) {
+	gen := a.session.generation()
+	alarm, err := a.retrieveAlarmOnce(ctx, moref)
+	if err == nil || !isNotAuthenticated(err) {
+		return alarm, err
+	}
+
+	logging.FromContext(ctx).Warnw("vsphere session not authenticated, logging in again", "moref", moref.String(), "error", err)
+	if err = a.session.relogin(ctx, gen); err != nil {
+		return mo.Alarm{}, fmt.Errorf("renew vsphere session: %w", err)
+	}
+
+	return a.retrieveAlarmOnce(ctx, moref)
+}
+
+func (a *alarmServer) retrieveAlarmOnce(ctx context.Context, moref types.ManagedObjectReference) (mo.Alarm, error) {
+	vc := a.session.client()
+	if vc == nil {
+		return mo.Alarm{}, errNotConnected
+	}
+
+	ctx, span := a.startSpan(ctx, "RetrieveOne",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("vsphere.alarm", moref.String())),
+	)
+	var alarm mo.Alarm
+	pc := property.DefaultCollector(vc.Client)
+	err := pc.RetrieveOne(ctx, moref, nil, &alarm)
+	endSpan(span, err)
+	if err != nil {
+		return mo.Alarm{}, err
+	}
+	return alarm, nil
 }
 
 // injectAlarmInfo creates a new event data []byte slice, patching AlarmInfo
@@ -226,6 +843,166 @@ func validateEnv(env envConfig) error {
 		return fmt.Errorf("CACHE_TTL must be greater than 0: %d", env.TTL)
 	}
 
+	if env.AdminPort < 0 {
+		return fmt.Errorf("ADMIN_PORT must not be negative: %d", env.AdminPort)
+	}
+
+	if env.AdminPort != 0 && env.AdminPort == env.Port {
+		return fmt.Errorf("ADMIN_PORT must differ from PORT: %d", env.AdminPort)
+	}
+
+	// the probes must not depend on the optional admin server
+	if env.HealthPort <= 0 {
+		return fmt.Errorf("HEALTH_PORT must be greater than 0: %d", env.HealthPort)
+	}
+
+	if env.HealthPort == env.Port || env.HealthPort == env.AdminPort {
+		return fmt.Errorf("HEALTH_PORT must differ from PORT and ADMIN_PORT: %d", env.HealthPort)
+	}
+
+	if env.MetricsPort < 0 {
+		return fmt.Errorf("METRICS_PORT must not be negative: %d", env.MetricsPort)
+	}
+
+	if env.MetricsPort != 0 && (env.MetricsPort == env.Port || env.MetricsPort == env.AdminPort || env.MetricsPort == env.HealthPort) {
+		return fmt.Errorf("METRICS_PORT must differ from PORT, ADMIN_PORT and HEALTH_PORT: %d", env.MetricsPort)
+	}
+
+	if env.RetryAttempts < 0 {
+		return fmt.Errorf("RETRY_ATTEMPTS must not be negative: %d", env.RetryAttempts)
+	}
+
+	if env.RetryBackoff < 0 || env.RetryMaxBackoff < 0 || env.RetryTimeout < 0 {
+		return fmt.Errorf("RETRY_BACKOFF, RETRY_MAX_BACKOFF and RETRY_TIMEOUT must not be negative")
+	}
+
+	if env.BreakerThreshold < 0 || env.BreakerCooldown < 0 {
+		return fmt.Errorf("BREAKER_THRESHOLD and BREAKER_COOLDOWN must not be negative")
+	}
+
+	if env.BreakerThreshold > 0 && (env.DegradedSuffix == "" || !validKey(env.DegradedSuffix)) {
+		return fmt.Errorf("DEGRADED_SUFFIX contains non-letter characters: %s", env.DegradedSuffix)
+	}
+
+	if _, err := newFailurePolicy(env); err != nil {
+		return err
+	}
+
+	if env.DrainTimeout < 0 {
+		return fmt.Errorf("DRAIN_TIMEOUT must not be negative: %v", env.DrainTimeout)
+	}
+
+	if env.FlushTimeout < 0 {
+		return fmt.Errorf("FLUSH_TIMEOUT must not be negative: %v", env.FlushTimeout)
+	}
+
+	if _, err := parseEventTimeMode(env.EventTime); err != nil {
+		return fmt.Errorf("EVENT_TIME: %w", err)
+	}
+
+	if _, err := newTypeMapper(typeMode(env.EventTypeMode), env.EventTypePrefix, ""); err != nil {
+		return err
+	}
+
+	if env.ClockSkewThreshold < 0 {
+		return fmt.Errorf("CLOCK_SKEW_THRESHOLD must not be negative: %v", env.ClockSkewThreshold)
+	}
+
+	if env.FlapWindow < 0 {
+		return fmt.Errorf("FLAP_WINDOW must not be negative: %v", env.FlapWindow)
+	}
+
+	if env.FlapWindow > 0 && (env.FlapThreshold < 1 || env.FlapMaxAlarms < 1) {
+		return fmt.Errorf("FLAP_THRESHOLD and FLAP_MAX_ALARMS must be greater than 0")
+	}
+
+	// the history is bounded, a higher threshold would never be reached
+	if env.FlapWindow > 0 && env.FlapThreshold > flapMaxTransitions {
+		return fmt.Errorf("FLAP_THRESHOLD must not be greater than %d: %d", flapMaxTransitions, env.FlapThreshold)
+	}
+
+	if env.DedupWindow < 0 {
+		return fmt.Errorf("DEDUP_WINDOW must not be negative: %v", env.DedupWindow)
+	}
+
+	if env.DedupWindow > 0 && env.DedupMaxEvents < 1 {
+		return fmt.Errorf("DEDUP_MAX_EVENTS must be greater than 0: %d", env.DedupMaxEvents)
+	}
+
+	if env.DebounceDelay < 0 {
+		return fmt.Errorf("DEBOUNCE_DELAY must not be negative: %v", env.DebounceDelay)
+	}
+
+	// held events are released after the received event was acknowledged
+	if env.DebounceDelay > 0 && env.Sink == "" && len(env.Sinks) == 0 {
+		return fmt.Errorf("DEBOUNCE_DELAY requires K_SINK or SINKS")
+	}
+
+	if env.DigestWindow < 0 {
+		return fmt.Errorf("DIGEST_WINDOW must not be negative: %v", env.DigestWindow)
+	}
+
+	if env.DigestWindow > 0 {
+		if _, err := parseDigestGroupBy(env.DigestGroupBy); err != nil {
+			return err
+		}
+		if env.DigestMaxEntities < 1 {
+			return fmt.Errorf("DIGEST_MAX_ENTITIES must be greater than 0: %d", env.DigestMaxEntities)
+		}
+		// digests are sent independent of received events
+		if env.Sink == "" && len(env.Sinks) == 0 {
+			return fmt.Errorf("DIGEST_WINDOW requires K_SINK or SINKS")
+		}
+	}
+
+	if env.HeartbeatInterval < 0 {
+		return fmt.Errorf("HEARTBEAT_INTERVAL must not be negative: %v", env.HeartbeatInterval)
+	}
+
+	if env.RecentEvents < 0 || env.RecentPayloadSize < 0 {
+		return fmt.Errorf("RECENT_EVENTS and RECENT_EVENTS_PAYLOAD_SIZE must not be negative")
+	}
+
+	if env.AuditLogMaxSize < 0 || env.AuditLogMaxBackups < 0 {
+		return fmt.Errorf("AUDIT_LOG_MAX_SIZE and AUDIT_LOG_MAX_BACKUPS must not be negative")
+	}
+
+	if env.CredentialsPollInterval < 0 {
+		return fmt.Errorf("CREDENTIALS_POLL_INTERVAL must not be negative: %v", env.CredentialsPollInterval)
+	}
+
+	if env.MaxInFlight < 0 || env.QueueSize < 0 || env.RetryAfter < 0 {
+		return fmt.Errorf("MAX_IN_FLIGHT, QUEUE_SIZE and RETRY_AFTER must not be negative")
+	}
+
+	if env.SinkRetryAttempts < 0 || env.SinkRetryBackoff < 0 || env.SinkRetryMaxBackoff < 0 || env.SinkTimeout < 0 {
+		return fmt.Errorf("SINK_RETRY_ATTEMPTS, SINK_RETRY_BACKOFF, SINK_RETRY_MAX_BACKOFF and SINK_TIMEOUT must not be negative")
+	}
+
+	configured := map[string]bool{}
+	for _, sink := range append([]string{env.Sink}, env.Sinks...) {
+		if sink = strings.TrimSpace(sink); sink != "" {
+			if err := validateSink(sink); err != nil {
+				return err
+			}
+			configured[sink] = true
+		}
+	}
+
+	timeouts, err := parseSinkTimeouts(env.SinkTimeouts)
+	if err != nil {
+		return err
+	}
+	for sink := range timeouts {
+		if !configured[sink] {
+			return fmt.Errorf("SINK_TIMEOUTS: %q is not configured in K_SINK or SINKS", sink)
+		}
+	}
+
+	if env.DeadLetterSink != "" && env.DeadLetterFile != "" {
+		return fmt.Errorf("DEADLETTER_SINK and DEADLETTER_FILE are mutually exclusive")
+	}
+
 	if strings.HasPrefix(env.EventSuffix, ".") {
 		return fmt.Errorf("EVEN_SUFFIX must not start with %q: %s", env.EventSuffix, ".")
 	}
@@ -234,11 +1011,10 @@ func validateEnv(env envConfig) error {
 }
 
 func isNotAuthenticated(err error) bool {
-	if soap.IsSoapFault(err) {
-		switch soap.ToSoapFault(err).VimFault().(type) {
-		case types.NotAuthenticated:
-			return true
-		}
+	fault, _ := vimFault(err)
+	switch fault.(type) {
+	case types.NotAuthenticated, *types.NotAuthenticated:
+		return true
 	}
 	return false
 }
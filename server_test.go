@@ -4,9 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/benbjohnson/clock"
 	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/vmware/govmomi"
+	sm "github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
 	"github.com/vmware/govmomi/vim25/xml"
@@ -60,11 +65,72 @@ func Test_validateEnv(t *testing.T) {
 				}},
 			wantErr: true,
 		},
+		{
+			name: "health server disabled",
+			args: args{
+				env: envConfig{
+					TTL:         10,
+					EventSuffix: "enriched",
+					InjectKey:   "AlarmKey",
+				}},
+			wantErr: true,
+		},
+		{
+			name: "health port same as admin port",
+			args: args{
+				env: envConfig{
+					AdminPort:   8081,
+					HealthPort:  8081,
+					TTL:         10,
+					EventSuffix: "enriched",
+					InjectKey:   "AlarmKey",
+				}},
+			wantErr: true,
+		},
+		{
+			name: "flap threshold above history size",
+			args: args{
+				env: envConfig{
+					HealthPort:    8082,
+					TTL:           10,
+					EventSuffix:   "enriched",
+					InjectKey:     "AlarmKey",
+					FlapWindow:    time.Hour,
+					FlapThreshold: flapMaxTransitions + 1,
+					FlapMaxAlarms: 1000,
+				}},
+			wantErr: true,
+		},
+		{
+			name: "sink timeout of unconfigured sink",
+			args: args{
+				env: envConfig{
+					HealthPort:   8082,
+					TTL:          10,
+					EventSuffix:  "enriched",
+					InjectKey:    "AlarmKey",
+					Sinks:        []string{"http://sink-1"},
+					SinkTimeouts: []string{"http://sink-2=30s"},
+				}},
+			wantErr: true,
+		},
+		{
+			name: "admin server disabled",
+			args: args{
+				env: envConfig{
+					HealthPort:  8082,
+					TTL:         10,
+					EventSuffix: "enriched",
+					InjectKey:   "AlarmKey",
+				}},
+			wantErr: false,
+		},
 		{
 			// only doing semantic verification since envconfig will do the heavy lifting
 			name: "valid env",
 			args: args{
 				env: envConfig{
+					HealthPort:  8082,
 					TTL:         10,
 					EventSuffix: "enriched",
 					InjectKey:   "AlarmKey",
@@ -136,17 +202,33 @@ func Test_injectAlarmInfo(t *testing.T) {
 func Test_alarmServer_handleEvent(t *testing.T) {
 	testEvents := createCloudEvents(t)
 
+	degradedEvent := testEvents["AlarmStatusChangedEvent"].Clone()
+	degradedEvent.SetType("AlarmStatusChangedEvent." + suffix + ".Degraded")
+	degradedEvent.SetExtension(enrichmentErrorExtension, errBreakerOpen.Error())
+	setOriginal(&degradedEvent, testEvents["AlarmStatusChangedEvent"])
+
+	enrichedEvent := testEvents["AlarmStatusChangedEvent."+suffix].Clone()
+	setOriginal(&enrichedEvent, testEvents["AlarmStatusChangedEvent"])
+
+	openBreaker := newBreaker(1, time.Hour, nil)
+	openBreaker.allow()
+	openBreaker.record(context.DeadlineExceeded)
+
 	type fields struct {
-		cache *cache
+		cache   *cache
+		breaker *breaker
+		policy  failurePolicy
 	}
 	type args struct {
 		event cloudevents.Event
 	}
 	tests := []struct {
-		name   string
-		fields fields
-		args   args
-		want   *cloudevents.Event
+		name        string
+		fields      fields
+		args        args
+		want        *cloudevents.Event
+		wantOutcome string
+		wantReason  string
 	}{
 		{
 			name: "event is not AlarmEvent",
@@ -156,7 +238,9 @@ func Test_alarmServer_handleEvent(t *testing.T) {
 			args: args{
 				event: *testEvents["VmPoweredOnEvent"],
 			},
-			want: nil,
+			want:        nil,
+			wantOutcome: outcomeIgnored,
+			wantReason:  reasonNotAlarm,
 		},
 		{
 			name: "ignore own (injected) event",
@@ -166,7 +250,9 @@ func Test_alarmServer_handleEvent(t *testing.T) {
 			args: args{
 				event: *testEvents["AlarmStatusChangedEvent.AlarmInfo"],
 			},
-			want: nil,
+			want:        nil,
+			wantOutcome: outcomeIgnored,
+			wantReason:  reasonSelf,
 		},
 		{
 			name: "ignore XML-encoded event",
@@ -176,7 +262,9 @@ func Test_alarmServer_handleEvent(t *testing.T) {
 			args: args{
 				event: *testEvents["AlarmStatusChangedEvent.XML"],
 			},
-			want: nil,
+			want:        nil,
+			wantOutcome: outcomeIgnored,
+			wantReason:  reasonNotJSON,
 		},
 		{
 			name: "event is AlarmStatusChangedEvent",
@@ -194,17 +282,38 @@ func Test_alarmServer_handleEvent(t *testing.T) {
 			args: args{
 				event: *testEvents["AlarmStatusChangedEvent"],
 			},
-			want: testEvents["AlarmStatusChangedEvent."+suffix],
+			want:        &enrichedEvent,
+			wantOutcome: outcomeEnriched,
+			wantReason:  "",
+		},
+		{
+			name: "vcenter unavailable returns degraded event",
+			fields: fields{
+				cache:   newAlarmCache(3600),
+				breaker: openBreaker,
+				policy:  failurePolicy{vcenter: actionPassthrough},
+			},
+			args: args{
+				event: *testEvents["AlarmStatusChangedEvent"],
+			},
+			want:        &degradedEvent,
+			wantOutcome: outcomeDegraded,
+			wantReason:  string(failureVCenter),
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			m := newMetrics()
 			a := &alarmServer{
 				ceClient:  nil,
+				metrics:   m,
 				cache:     tt.fields.cache,
+				breaker:   tt.fields.breaker,
+				policy:    tt.fields.policy,
 				source:    vc,
 				suffix:    "." + suffix,
 				injectKey: injectKey,
+				degraded:  ".Degraded",
 			}
 
 			logger := zaptest.NewLogger(t).Sugar()
@@ -212,12 +321,71 @@ func Test_alarmServer_handleEvent(t *testing.T) {
 			defer cancel()
 			ctx = logging.WithLogger(ctx, logger)
 
-			got := a.handleEvent(ctx, tt.args.event)
+			got, result := a.handleEvent(ctx, tt.args.event)
 			assert.DeepEqual(t, got, tt.want)
+			assert.Assert(t, result == nil, "result: %v", result)
+			assert.Equal(t, m.events.get(tt.wantOutcome, tt.wantReason), float64(1))
+		})
+	}
+}
+
+func Test_alarmServer_newResponse_ids(t *testing.T) {
+	event := cloudevents.NewEvent()
+	event.SetID("42")
+	event.SetSource(vc)
+	event.SetType("AlarmStatusChangedEvent")
+
+	redelivered := event.Clone()
+	other := event.Clone()
+	other.SetID("43")
+
+	tests := []struct {
+		name          string
+		deterministic bool
+	}{
+		{name: "random ids", deterministic: false},
+		{name: "deterministic ids", deterministic: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &alarmServer{source: vc, deterministicIDs: tt.deterministic}
+			eventType := "AlarmStatusChangedEvent." + suffix
+
+			resp, err := a.newResponse(context.Background(), event, eventType, []byte(`{}`))
+			assert.NilError(t, err)
+			assert.Equal(t, resp.Extensions()[originalIDExtension], "42")
+			assert.Equal(t, resp.Extensions()[originalTypeExtension], "AlarmStatusChangedEvent")
+			assert.Equal(t, resp.Extensions()[originalSourceExtension], vc)
+
+			if !tt.deterministic {
+				// set by the client
+				assert.Equal(t, resp.ID(), "")
+				return
+			}
+
+			again, err := a.newResponse(context.Background(), redelivered, eventType, []byte(`{}`))
+			assert.NilError(t, err)
+			assert.Equal(t, again.ID(), resp.ID(), "redelivered event must result in the same id")
+
+			degraded, err := a.newResponse(context.Background(), event, eventType+".Degraded", []byte(`{}`))
+			assert.NilError(t, err)
+			assert.Assert(t, degraded.ID() != resp.ID(), "different response type must result in a different id")
+
+			otherResp, err := a.newResponse(context.Background(), other, eventType, []byte(`{}`))
+			assert.NilError(t, err)
+			assert.Assert(t, otherResp.ID() != resp.ID(), "different event must result in a different id")
 		})
 	}
 }
 
+// setOriginal sets the extensions referencing the original event on the
+// expected response
+func setOriginal(resp *cloudevents.Event, original *cloudevents.Event) {
+	resp.SetExtension(originalIDExtension, original.ID())
+	resp.SetExtension(originalTypeExtension, original.Type())
+	resp.SetExtension(originalSourceExtension, original.Source())
+}
+
 func createAlarm(t *testing.T, name string) mo.Alarm {
 	t.Helper()
 	return mo.Alarm{
@@ -235,6 +403,20 @@ func createAlarm(t *testing.T, name string) mo.Alarm {
 	}
 }
 
+// simulatorClient registers the alarms with the simulator and returns a client
+// of the simulator. vcsim does not implement the AlarmManager, thus the alarms
+// are registered directly.
+func simulatorClient(t *testing.T, client *vim25.Client, alarms ...string) *govmomi.Client {
+	t.Helper()
+
+	for _, name := range alarms {
+		alarm := createAlarm(t, name)
+		alarm.Self = alarm.Info.Alarm
+		simulator.Map.Put(&alarm)
+	}
+	return &govmomi.Client{Client: client, SessionManager: sm.NewManager(client)}
+}
+
 func createCloudEvents(t *testing.T) map[string]*cloudevents.Event {
 	t.Helper()
 
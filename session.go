@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	userFileKey      = "username"
+	passwordFileKey  = "password"
+	maxLoginFailures = 3 // consecutive failed logins before giving up on the session
+
+	connectBackoff    = time.Second
+	connectMaxBackoff = time.Minute
+)
+
+var (
+	// errSessionLost is returned when the vCenter session could not be
+	// recovered after repeated login attempts
+	errSessionLost = errors.New("vsphere session lost")
+
+	// errNotConnected is returned for vCenter calls before the initial
+	// connection to vCenter has been established
+	errNotConnected = errors.New("not connected to vcenter")
+)
+
+// session holds the vCenter client once connected and recovers its session by
+// logging in again with the credentials from the mounted secret. Concurrent
+// login attempts are serialized so that callers which observed the same
+// expired session only trigger a single login.
+type session struct {
+	secretPath string
+	metrics    *metrics
+	status     *statusEmitter
+
+	sync.Mutex
+	vc          *govmomi.Client // nil until connected
+	gen         uint64          // incremented after each successful login
+	failures    int             // consecutive failed logins
+	fingerprint string          // hash of the credentials used for the last login
+}
+
+// newSession returns a session for the specified client which may be nil if
+// not connected yet
+func newSession(client *govmomi.Client, secretPath string) *session {
+	return &session{
+		vc:         client,
+		secretPath: secretPath,
+	}
+}
+
+// client returns the vCenter client or nil if not connected
+func (s *session) client() *govmomi.Client {
+	s.Lock()
+	defer s.Unlock()
+	return s.vc
+}
+
+// connected returns whether the initial connection to vCenter has been
+// established
+func (s *session) connected() bool {
+	return s.client() != nil
+}
+
+// setClient sets the connected client. The client is expected to be logged in
+// with the credentials currently in the secret.
+func (s *session) setClient(client *govmomi.Client) {
+	s.Lock()
+	defer s.Unlock()
+	s.vc = client
+	if user, err := readCredentials(s.secretPath); err == nil {
+		s.fingerprint = fingerprint(user)
+	}
+}
+
+// generation returns the current session generation which must be passed to
+// relogin when the session is found to be not authenticated
+func (s *session) generation() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.gen
+}
+
+// relogin logs in to vCenter again unless the session has already been renewed
+// since the specified generation was observed. errSessionLost is returned
+// after maxLoginFailures consecutive failed logins.
+func (s *session) relogin(ctx context.Context, gen uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.gen != gen {
+		// another caller already renewed the session
+		return nil
+	}
+
+	if s.vc == nil {
+		return errNotConnected
+	}
+
+	s.status.sessionLost(ctx, errNotAuthenticated)
+	err := s.login(ctx)
+	s.metrics.login(loginRelogin, err)
+	if err != nil {
+		s.failures++
+		if s.failures >= maxLoginFailures {
+			return fmt.Errorf("%w: %d consecutive login failures: %v", errSessionLost, s.failures, err)
+		}
+		return err
+	}
+
+	s.failures = 0
+	s.gen++
+	s.status.sessionRestored(ctx)
+	return nil
+}
+
+func (s *session) login(ctx context.Context) error {
+	user, err := readCredentials(s.secretPath)
+	if err != nil {
+		return fmt.Errorf("read vsphere credentials: %w", err)
+	}
+
+	if err = s.vc.SessionManager.Login(ctx, user); err != nil {
+		return fmt.Errorf("login to vcenter: %w", err)
+	}
+	s.fingerprint = fingerprint(user)
+	return nil
+}
+
+// rotate logs in with a new client created by newClient if the credentials in
+// the secret changed since the last login and returns whether it did. vCenter
+// rejects logins on an authenticated session, so the new client is swapped in
+// once logged in and only then the previous session is terminated. Retrievals
+// failing with the previous session retry with the new one in relogin. If the
+// login with the new credentials fails, the previous session is kept and the
+// login is retried on the next call.
+func (s *session) rotate(ctx context.Context, newClient func(ctx context.Context) (*govmomi.Client, error)) (bool, error) {
+	s.Lock()
+	connected := s.vc != nil
+	current := s.fingerprint
+	s.Unlock()
+
+	if !connected {
+		// the initial connection reads the current credentials
+		return false, nil
+	}
+
+	user, err := readCredentials(s.secretPath)
+	if err != nil {
+		return false, fmt.Errorf("read vsphere credentials: %w", err)
+	}
+	if fingerprint(user) == current {
+		return false, nil
+	}
+
+	vc, err := newClient(ctx)
+	s.metrics.login(loginRotation, err)
+	if err != nil {
+		return false, fmt.Errorf("login to vcenter: %w", err)
+	}
+
+	s.Lock()
+	previous := s.vc
+	s.vc = vc
+	s.fingerprint = fingerprint(user)
+	s.failures = 0
+	s.gen++
+	s.Unlock()
+
+	if err = previous.SessionManager.Logout(ctx); err != nil {
+		logging.FromContext(ctx).Debugf("logout from vcenter after rotation: %v", err)
+	}
+	return true, nil
+}
+
+// fingerprint returns a hash of the specified credentials so that the
+// password is not kept in memory to detect changes
+func fingerprint(user *url.Userinfo) string {
+	password, _ := user.Password()
+	h := sha256.Sum256([]byte(user.Username() + "\x00" + password))
+	return hex.EncodeToString(h[:])
+}
+
+// readCredentials reads the username and password files from the specified
+// secret path
+func readCredentials(secretPath string) (*url.Userinfo, error) {
+	username, err := ioutil.ReadFile(filepath.Join(secretPath, userFileKey))
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := ioutil.ReadFile(filepath.Join(secretPath, passwordFileKey))
+	if err != nil {
+		return nil, err
+	}
+
+	return url.UserPassword(string(username), string(password)), nil
+}
+
+// watchCredentials periodically checks the mounted secret for changed
+// credentials and logs in again with the new credentials, keeping the alarm
+// cache and in-flight events. Polling also covers Kubernetes secret updates
+// which atomically swap the symlink of the secret directory. A zero interval
+// disables the watch.
+func (a *alarmServer) watchCredentials(ctx context.Context) error {
+	if a.credentialsInterval == 0 {
+		return nil
+	}
+
+	logger := logging.FromContext(ctx)
+	t := time.NewTicker(a.credentialsInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debugf("stopping credentials watch: %v", ctx.Err())
+			return nil
+		case <-t.C:
+			rotated, err := a.session.rotate(ctx, a.newClient)
+			if err != nil {
+				logger.Warnw("could not log in with rotated vsphere credentials", "error", err)
+				continue
+			}
+			if rotated {
+				logger.Infow("logged in with rotated vsphere credentials", "generation", a.session.generation())
+			}
+		}
+	}
+}
+
+// connect establishes the initial vCenter connection, retrying with backoff
+// until vCenter is reachable. Faults returned by vCenter, e.g. invalid
+// credentials, are not retried.
+func (a *alarmServer) connect(ctx context.Context) error {
+	if a.session.connected() {
+		return nil
+	}
+
+	logger := logging.FromContext(ctx)
+	backoff := retryPolicy{backoff: connectBackoff, maxBackoff: connectMaxBackoff}
+
+	for attempt := 1; ; attempt++ {
+		vc, err := a.newClient(ctx)
+		if err == nil {
+			a.session.setClient(vc)
+			logger.Infow("connected to vcenter", "attempts", attempt)
+			a.status.notify(ctx, statusTypeConnected, nil)
+			return nil
+		}
+
+		if _, ok := vimFault(err); ok || ctx.Err() != nil {
+			return fmt.Errorf("create vsphere client: %w", err)
+		}
+
+		d := backoff.delay(attempt)
+		logger.Warnw("could not connect to vcenter, retrying", "attempt", attempt, "backoff", d.String(), "error", err)
+
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
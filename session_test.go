@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func Test_alarmServer_retrieveAlarm(t *testing.T) {
+	const (
+		username = "administrator@vsphere.local"
+		password = "passw0rd"
+	)
+
+	tests := []struct {
+		name     string
+		password string // password in the mounted secret
+		handlers int    // concurrent retrievals after the session expired
+		wantErr  error
+		wantGen  uint64
+	}{
+		{
+			name:     "re-login once for concurrent retrievals",
+			password: password,
+			handlers: 10,
+			wantErr:  nil,
+			wantGen:  1,
+		},
+		{
+			name:     "session lost after repeated login failures",
+			password: "wrong-password",
+			handlers: maxLoginFailures,
+			wantErr:  errSessionLost,
+			wantGen:  0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := simulator.VPX()
+			defer model.Remove()
+			err := model.Create()
+			assert.NilError(t, err)
+
+			model.Service.Listen = &url.URL{
+				User: url.UserPassword(username, password),
+			}
+
+			simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+				vc := simulatorClient(t, client, "alarm-1")
+				moref := createAlarm(t, "alarm-1").Info.Alarm
+				a := &alarmServer{
+					session: newSession(vc, createSecret(t, username, tt.password)),
+				}
+				ctx = logging.WithLogger(ctx, zaptest.NewLogger(t).Sugar())
+
+				// expire session
+				err := vc.SessionManager.Logout(ctx)
+				assert.NilError(t, err)
+
+				var (
+					wg   sync.WaitGroup
+					mu   sync.Mutex
+					errs []error
+				)
+				for i := 0; i < tt.handlers; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						got, err := a.retrieveAlarm(ctx, moref)
+						mu.Lock()
+						defer mu.Unlock()
+						if err != nil {
+							errs = append(errs, err)
+							return
+						}
+						if got.Info.Name != "alarm-1" {
+							errs = append(errs, errors.New("unexpected alarm: "+got.Info.Name))
+						}
+					}()
+				}
+				wg.Wait()
+
+				if tt.wantErr == nil {
+					assert.Equal(t, len(errs), 0, "errors: %v", errs)
+				} else {
+					var lost bool
+					for _, err := range errs {
+						if errors.Is(err, tt.wantErr) {
+							lost = true
+						}
+					}
+					assert.Assert(t, lost, "errors: %v", errs)
+				}
+				assert.Equal(t, a.session.generation(), tt.wantGen)
+				return nil
+			}, model)
+		})
+	}
+}
+
+func Test_isNotAuthenticated(t *testing.T) {
+	simulator.Test(func(ctx context.Context, client *vim25.Client) {
+		vc := simulatorClient(t, client, "alarm-1")
+		moref := createAlarm(t, "alarm-1").Info.Alarm
+		a := &alarmServer{session: newSession(vc, "")}
+
+		_, err := a.retrieveAlarmOnce(ctx, moref)
+		assert.NilError(t, err)
+
+		err = vc.SessionManager.Logout(ctx)
+		assert.NilError(t, err)
+
+		_, err = a.retrieveAlarmOnce(ctx, moref)
+		assert.Assert(t, isNotAuthenticated(err), "error: %v", err)
+	})
+}
+
+func Test_alarmServer_connect(t *testing.T) {
+	unreachable := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name          string
+		errs          []error // errors returned by consecutive connection attempts
+		cancel        bool    // cancel context after the first attempt
+		wantCalls     int
+		wantErr       bool
+		wantConnected bool
+	}{
+		{
+			name:          "connects on first attempt",
+			wantCalls:     1,
+			wantErr:       false,
+			wantConnected: true,
+		},
+		{
+			name:          "retries until vcenter is reachable",
+			errs:          []error{unreachable},
+			wantCalls:     2,
+			wantErr:       false,
+			wantConnected: true,
+		},
+		{
+			name:          "vcenter fault is not retried",
+			errs:          []error{soap.WrapVimFault(&types.InvalidLogin{})},
+			wantCalls:     1,
+			wantErr:       true,
+			wantConnected: false,
+		},
+		{
+			name:          "stops retrying when cancelled",
+			errs:          []error{unreachable, unreachable},
+			cancel:        true,
+			wantCalls:     1,
+			wantErr:       true,
+			wantConnected: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar()))
+			defer cancel()
+
+			var calls int
+			a := &alarmServer{
+				session: newSession(nil, ""),
+				newClient: func(ctx context.Context) (*govmomi.Client, error) {
+					calls++
+					if tt.cancel {
+						cancel()
+					}
+					if calls <= len(tt.errs) {
+						return nil, tt.errs[calls-1]
+					}
+					return &govmomi.Client{}, nil
+				},
+			}
+
+			_, err := a.retrieveAlarmOnce(ctx, types.ManagedObjectReference{Type: "Alarm", Value: "alarm-1"})
+			assert.Assert(t, errors.Is(err, errNotConnected), "error: %v", err)
+
+			err = a.connect(ctx)
+			assert.Equal(t, calls, tt.wantCalls)
+			assert.Equal(t, err != nil, tt.wantErr, "error: %v", err)
+			assert.Equal(t, a.session.connected(), tt.wantConnected)
+		})
+	}
+}
+
+func Test_session_rotate(t *testing.T) {
+	const (
+		username = "administrator@vsphere.local"
+		password = "passw0rd"
+		rotated  = "r0tated"
+	)
+
+	model := simulator.VPX()
+	defer model.Remove()
+	err := model.Create()
+	assert.NilError(t, err)
+
+	model.Service.Listen = &url.URL{
+		User: url.UserPassword(username, password),
+	}
+
+	simulator.Run(func(ctx context.Context, client *vim25.Client) error {
+		vc := simulatorClient(t, client, "alarm-1")
+		moref := createAlarm(t, "alarm-1").Info.Alarm
+		ctx = logging.WithLogger(ctx, zaptest.NewLogger(t).Sugar())
+		secret := createK8sSecret(t, username, password)
+
+		s := newSession(nil, secret)
+		s.metrics = newMetrics()
+		s.setClient(vc)
+		a := &alarmServer{session: s}
+
+		// logs in with the credentials currently in the secret
+		var clients int
+		newClient := func(ctx context.Context) (*govmomi.Client, error) {
+			clients++
+			user, err := readCredentials(secret)
+			if err != nil {
+				return nil, err
+			}
+			u := *client.URL()
+			u.User = user
+			return govmomi.NewClient(ctx, &u, true)
+		}
+
+		ok, err := s.rotate(ctx, newClient)
+		assert.NilError(t, err)
+		assert.Assert(t, !ok, "credentials did not change")
+
+		// password rotated in vcenter, secret not updated yet
+		model.Service.Listen.User = url.UserPassword(username, rotated)
+		ok, err = s.rotate(ctx, newClient)
+		assert.NilError(t, err)
+		assert.Assert(t, !ok, "credentials did not change")
+		assert.Equal(t, clients, 0)
+
+		// the session of the previous credentials is still valid
+		_, err = a.retrieveAlarm(ctx, moref)
+		assert.NilError(t, err)
+
+		updateK8sSecret(t, secret, username, rotated)
+		ok, err = s.rotate(ctx, newClient)
+		assert.NilError(t, err)
+		assert.Assert(t, ok, "credentials changed")
+		assert.Equal(t, s.generation(), uint64(1))
+		assert.Assert(t, s.client() != vc, "new client swapped in")
+
+		_, err = a.retrieveAlarm(ctx, moref)
+		assert.NilError(t, err)
+
+		// invalid credentials keep the current session and are retried on the
+		// next rotation
+		rotatedClient := s.client()
+		updateK8sSecret(t, secret, username, "wrong-password")
+		_, err = s.rotate(ctx, newClient)
+		assert.Assert(t, err != nil)
+		assert.Equal(t, s.client(), rotatedClient)
+		assert.Equal(t, s.generation(), uint64(1))
+
+		_, err = a.retrieveAlarm(ctx, moref)
+		assert.NilError(t, err)
+
+		_, err = s.rotate(ctx, newClient)
+		assert.Assert(t, err != nil, "must log in again after a failed rotation")
+
+		// secret fixed, the session already uses these credentials
+		updateK8sSecret(t, secret, username, rotated)
+		ok, err = s.rotate(ctx, newClient)
+		assert.NilError(t, err)
+		assert.Assert(t, !ok, "credentials did not change")
+		assert.Equal(t, s.generation(), uint64(1))
+
+		_, err = a.retrieveAlarm(ctx, moref)
+		assert.NilError(t, err)
+
+		assert.Equal(t, clients, 3)
+		assert.Equal(t, s.metrics.logins.get(loginRotation, "success"), float64(1))
+		assert.Equal(t, s.metrics.logins.get(loginRotation, "failure"), float64(2))
+		return nil
+	}, model)
+}
+
+// createK8sSecret creates a secret directory with the layout of a mounted
+// Kubernetes secret, i.e. the files are symlinks into a versioned directory
+// which is swapped atomically on updates
+func createK8sSecret(t *testing.T, username, password string) string {
+	t.Helper()
+	dir := t.TempDir()
+	updateK8sSecret(t, dir, username, password)
+
+	for _, key := range []string{userFileKey, passwordFileKey} {
+		err := os.Symlink(filepath.Join("..data", key), filepath.Join(dir, key))
+		assert.NilError(t, err)
+	}
+	return dir
+}
+
+func updateK8sSecret(t *testing.T, dir, username, password string) {
+	t.Helper()
+	version, err := ioutil.TempDir(dir, "..version_")
+	assert.NilError(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(version, userFileKey), []byte(username), 0444)
+	assert.NilError(t, err)
+	err = ioutil.WriteFile(filepath.Join(version, passwordFileKey), []byte(password), 0444)
+	assert.NilError(t, err)
+
+	tmp := filepath.Join(dir, "..data_tmp")
+	err = os.Symlink(filepath.Base(version), tmp)
+	assert.NilError(t, err)
+	err = os.Rename(tmp, filepath.Join(dir, "..data"))
+	assert.NilError(t, err)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"knative.dev/pkg/logging"
+)
+
+// inflight tracks the events currently being handled. Once draining, no new
+// events are accepted.
+type inflight struct {
+	sync.Mutex
+	n        int
+	draining bool
+	done     chan struct{} // closed when draining and no events are in flight
+}
+
+func newInflight() *inflight {
+	return &inflight{done: make(chan struct{})}
+}
+
+// begin registers an event and returns false if the server is draining
+func (i *inflight) begin() bool {
+	i.Lock()
+	defer i.Unlock()
+	if i.draining {
+		return false
+	}
+	i.n++
+	return true
+}
+
+// end unregisters an event registered with begin
+func (i *inflight) end() {
+	i.Lock()
+	defer i.Unlock()
+	i.n--
+	if i.draining && i.n == 0 {
+		close(i.done)
+	}
+}
+
+// count returns the number of events in flight
+func (i *inflight) count() int {
+	i.Lock()
+	defer i.Unlock()
+	return i.n
+}
+
+// drain stops accepting new events and waits until all events in flight are
+// handled or the timeout expired. Returns false on timeout.
+func (i *inflight) drain(timeout time.Duration) bool {
+	i.Lock()
+	if !i.draining {
+		i.draining = true
+		if i.n == 0 {
+			close(i.done)
+		}
+	}
+	i.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-i.done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// receiver returns the CloudEvents receiver function tracking in-flight events.
+// Events are handled with a context which is not cancelled when the receiver
+// stops, but when handlerCtx is cancelled, i.e. after the drain timeout.
+func (a *alarmServer) receiver(handlerCtx context.Context) func(context.Context, cloudevents.Event) (*cloudevents.Event, cloudevents.Result) {
+	return func(ctx context.Context, event cloudevents.Event) (*cloudevents.Event, cloudevents.Result) {
+		if !a.inflight.begin() {
+			d := &decision{start: a.now()}
+			d.step("reject event while shutting down")
+			a.outcome(withDecision(ctx, d), event, outcomeRejected, reasonShutdown)
+			a.record(event, d)
+			return nil, cehttp.NewResult(http.StatusServiceUnavailable, "server is shutting down")
+		}
+		defer a.inflight.end()
+
+		return a.handleEvent(detach(ctx, handlerCtx), event)
+	}
+}
+
+// shutdown drains in-flight events up to the drain timeout, then cancels the
+// remaining handlers, releases held events and pending digests, closes the
+// dead-letter sink, exports the remaining spans and logs out from vCenter
+func (a *alarmServer) shutdown(ctx context.Context, cancelHandlers context.CancelFunc) {
+	logger := logging.FromContext(ctx)
+	logger.Infow("shutting down, draining in-flight events", "in_flight", a.inflight.count(), "timeout", a.drainTimeout.String())
+
+	if !a.inflight.drain(a.drainTimeout) {
+		logger.Warnw("drain timeout exceeded, cancelling in-flight events", "in_flight", a.inflight.count())
+	}
+	cancelHandlers()
+
+	// held events were acknowledged and would be lost, releases must complete
+	// before logging out. Releases exceeding the flush timeout are cancelled and
+	// dead-lettered so that the pod is not killed before logging out. Pending
+	// digests share the timeout.
+	if n := a.debounce.held(); n > 0 {
+		logger.Infow("releasing held events", "held", n, "timeout", a.flushTimeout.String())
+	}
+	flushCtx, cancelFlush := context.WithTimeout(detach(ctx, context.Background()), a.flushTimeout)
+	a.debounce.flush(flushCtx)
+	a.digests.flush(flushCtx)
+	cancelFlush()
+
+	if a.deadLetters != nil {
+		if err := a.deadLetters.close(); err != nil {
+			logger.Warnf("close dead-letter sink: %v", err)
+		}
+	}
+
+	// the context is cancelled on shutdown
+	a.status.lifecycle(detach(ctx, context.Background()), statusTypeStopped, nil)
+
+	if a.auditFile != nil {
+		_ = a.auditLog.Sync()
+		if err := a.auditFile.Close(); err != nil {
+			logger.Warnf("close audit log: %v", err)
+		}
+	}
+
+	if a.tracerProvider != nil {
+		// export the remaining spans including those of the flush
+		exportCtx, cancelExport := context.WithTimeout(detach(ctx, context.Background()), a.flushTimeout)
+		if err := a.tracerProvider.Shutdown(exportCtx); err != nil {
+			logger.Warnf("export spans: %v", err)
+		}
+		cancelExport()
+	}
+
+	if vc := a.session.client(); vc != nil {
+		if err := vc.Logout(context.TODO()); err != nil {
+			logger.Debugf("logout from vcenter: %v", err)
+		}
+	}
+	logger.Info("shutdown complete")
+}
+
+// detachedContext carries the values of one context and the deadline and
+// cancellation of another context
+type detachedContext struct {
+	context.Context
+	values context.Context
+}
+
+// detach returns a context with the values (e.g. logger) of values which is
+// only cancelled when cancel is cancelled
+func detach(values, cancel context.Context) context.Context {
+	return detachedContext{Context: cancel, values: values}
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	if v := c.values.Value(key); v != nil {
+		return v
+	}
+	return c.Context.Value(key)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func Test_alarmServer_run_drain(t *testing.T) {
+	const (
+		port     = 50003
+		requests = 5
+		delay    = time.Millisecond * 500 // vcenter latency
+	)
+
+	testEvents := createCloudEvents(t)
+
+	simulator.Test(func(ctx context.Context, client *vim25.Client) {
+		vc := simulatorClient(t, client, "alarm-1")
+
+		var retrievals int32
+		simulator.Map.Handler = func(_ *simulator.Context, m *simulator.Method) (mo.Reference, types.BaseMethodFault) {
+			if m.Name == "RetrieveProperties" || m.Name == "RetrievePropertiesEx" {
+				atomic.AddInt32(&retrievals, 1)
+				time.Sleep(delay)
+			}
+			return nil, nil
+		}
+		defer func() { simulator.Map.Handler = nil }()
+
+		p, err := cloudevents.NewHTTP(cloudevents.WithPort(port), cehttp.WithShutdownTimeout(time.Second*5))
+		assert.NilError(t, err)
+		ce, err := cloudevents.NewClient(p, cloudevents.WithTimeNow(), cloudevents.WithUUIDs())
+		assert.NilError(t, err)
+
+		a := &alarmServer{
+			session:      newSession(vc, ""),
+			ceClient:     ce,
+			cache:        newAlarmCache(3600),
+			errCh:        make(chan error, 1),
+			source:       vc.URL().String(),
+			suffix:       "." + suffix,
+			injectKey:    injectKey,
+			inflight:     newInflight(),
+			drainTimeout: time.Second * 5,
+		}
+
+		ctx, cancel := context.WithCancel(logging.WithLogger(ctx, zaptest.NewLogger(t).Sugar()))
+		defer cancel()
+
+		runErr := make(chan error, 1)
+		go func() {
+			runErr <- a.run(ctx)
+		}()
+		waitForPort(t, port)
+
+		sender, err := cloudevents.NewClientHTTP(cloudevents.WithTarget("http://localhost:" + strconv.Itoa(port)))
+		assert.NilError(t, err)
+
+		type response struct {
+			event  *cloudevents.Event
+			result cloudevents.Result
+		}
+		responses := make(chan response, requests)
+		for i := 0; i < requests; i++ {
+			go func() {
+				event := testEvents["AlarmStatusChangedEvent"].Clone()
+				event.SetID(strconv.Itoa(int(time.Now().UnixNano())))
+				resp, res := sender.Request(context.Background(), event)
+				responses <- response{event: resp, result: res}
+			}()
+		}
+
+		// shut down while all requests are waiting for vcenter
+		for atomic.LoadInt32(&retrievals) < requests {
+			time.Sleep(time.Millisecond * 10)
+		}
+		cancel()
+
+		for i := 0; i < requests; i++ {
+			r := <-responses
+			assert.Assert(t, cloudevents.IsACK(r.result), "result: %v", r.result)
+			assert.Assert(t, r.event != nil)
+			assert.Equal(t, r.event.Type(), "AlarmStatusChangedEvent."+suffix)
+		}
+
+		err = <-runErr
+		assert.Assert(t, err == nil || errors.Is(err, context.Canceled), "error: %v", err)
+		assert.Equal(t, a.inflight.count(), 0)
+	})
+}
+
+func Test_inflight_drain(t *testing.T) {
+	i := newInflight()
+	assert.Assert(t, i.begin())
+
+	// timeout while an event is in flight
+	assert.Assert(t, !i.drain(time.Millisecond*10))
+	assert.Assert(t, !i.begin(), "must not accept events while draining")
+
+	i.end()
+	assert.Assert(t, i.drain(time.Millisecond*10))
+}
+
+func waitForPort(t *testing.T, port int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(port))
+		if err == nil {
+			_ = conn.Close()
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Fatalf("port %d not listening", port)
+}
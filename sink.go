@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/client"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/google/uuid"
+	"knative.dev/pkg/logging"
+)
+
+// sinks forwards returned events to one or more HTTP CloudEvents sinks instead
+// of replying to the received event, e.g. when the server is bound to a sink
+// with a Knative SinkBinding (K_SINK). Events are sent to all sinks
+// concurrently, each sink with its own retries. A nil sinks replies.
+type sinks struct {
+	client   client.Client
+	targets  []string
+	timeouts map[string]time.Duration // per attempt deadline overriding the retry policy, keyed by target
+	retry    retryPolicy
+	metrics  *metrics
+}
+
+// newSinks returns the sinks for the specified targets, duplicates and empty
+// targets are ignored. If no target is specified, nil sinks are returned.
+// Timeouts override the per attempt deadline of the retry policy for the
+// targets.
+func newSinks(targets []string, timeouts map[string]time.Duration, retry retryPolicy, m *metrics) (*sinks, error) {
+	var unique []string
+	seen := map[string]bool{}
+	for _, t := range targets {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
+		}
+		if err := validateSink(t); err != nil {
+			return nil, err
+		}
+		seen[t] = true
+		unique = append(unique, t)
+	}
+
+	if len(unique) == 0 {
+		return nil, nil
+	}
+
+	retry.retryable = isSinkRetryable
+	c, err := cloudevents.NewClientHTTP()
+	if err != nil {
+		return nil, fmt.Errorf("create sink cloudevents client: %w", err)
+	}
+	return &sinks{client: c, targets: unique, timeouts: timeouts, retry: retry, metrics: m}, nil
+}
+
+// parseSinkTimeouts parses the comma-separated <sink>=<timeout> entries of
+// SINK_TIMEOUTS
+func parseSinkTimeouts(entries []string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	for _, entry := range entries {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		// the sink URL may contain "=" in the query
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("SINK_TIMEOUTS: invalid entry %q, must be <sink>=<timeout>", entry)
+		}
+		sink := strings.TrimSpace(entry[:i])
+		timeout, err := time.ParseDuration(strings.TrimSpace(entry[i+1:]))
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("SINK_TIMEOUTS: invalid timeout in %q", entry)
+		}
+		if err = validateSink(sink); err != nil {
+			return nil, fmt.Errorf("SINK_TIMEOUTS: %w", err)
+		}
+		timeouts[sink] = timeout
+	}
+	return timeouts, nil
+}
+
+func validateSink(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid sink %q: %w", target, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid sink %q: must be an http or https URL", target)
+	}
+	return nil
+}
+
+// send sends the event to all sinks and returns the errors of the sinks which
+// did not accept the event after retries, keyed by target
+func (s *sinks) send(ctx context.Context, event cloudevents.Event) map[string]error {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed = map[string]error{}
+	)
+
+	for _, target := range s.targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+
+			retry := s.retry
+			if timeout, ok := s.timeouts[target]; ok {
+				retry.timeout = timeout
+			}
+			err := retry.do(ctx, func(ctx context.Context) error {
+				res := s.client.Send(cloudevents.ContextWithTarget(ctx, target), event)
+				if cloudevents.IsACK(res) {
+					return nil
+				}
+				return res
+			})
+			s.metrics.delivery(target, err)
+			if err == nil {
+				return
+			}
+
+			mu.Lock()
+			failed[target] = err
+			mu.Unlock()
+		}(target)
+	}
+	wg.Wait()
+	return failed
+}
+
+// identify sets a random ID and the specified time on the event unless set.
+// Otherwise the client sets them on every send, i.e. each sink and each retry
+// would receive a different ID and time.
+func identify(event *cloudevents.Event, now time.Time) {
+	if event.ID() == "" {
+		event.SetID(uuid.New().String())
+	}
+	if event.Time().IsZero() {
+		event.SetTime(now)
+	}
+}
+
+// isSinkRetryable returns whether sending to a sink failing with the specified
+// error may succeed when retried. Rejections by the sink other than server
+// errors, timeouts and throttling are considered permanent.
+func isSinkRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var res *cehttp.Result
+	if errors.As(err, &res) {
+		switch res.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return true
+		default:
+			return res.StatusCode >= http.StatusInternalServerError
+		}
+	}
+
+	// not delivered, e.g. connection refused or deadline exceeded
+	return true
+}
+
+// deliver sends the response to the sinks and returns whether all sinks
+// accepted it. The received event is acknowledged once all sinks accepted the
+// response. Otherwise the sink failure policy applies: the received event is
+// rejected for redelivery (nack) or acknowledged and sent to the dead-letter
+// sink (ack). Redelivered events are
+// sent to all sinks again, thus with nack the response ID is derived from the
+// received event so that sinks which already accepted the response can
+// discard it as duplicate.
+func (a *alarmServer) deliver(ctx context.Context, event cloudevents.Event, resp *cloudevents.Event) (bool, cloudevents.Result) {
+	logger := logging.FromContext(ctx)
+	d := decisionFrom(ctx)
+
+	if resp.ID() == "" && a.policy.action(failureSink) == actionNACK {
+		resp.SetID(responseID(event, resp.Type()))
+	}
+	identify(resp, a.now())
+	failed := a.sinks.send(ctx, *resp)
+	if len(failed) == 0 {
+		logger.Debugw("delivered event to sinks", "type", resp.Type(), "sinks", len(a.sinks.targets))
+		d.step("deliver to %d sinks", len(a.sinks.targets))
+		return true, nil
+	}
+
+	var reasons []string
+	for _, target := range a.sinks.targets {
+		if err, ok := failed[target]; ok {
+			logger.Errorw("could not deliver event to sink", "id", event.ID(), "sink", target, "error", err)
+			d.step("deliver to sink %s: %v", target, err)
+			reasons = append(reasons, fmt.Sprintf("%s: %v", target, err))
+		}
+	}
+	err := fmt.Errorf("deliver to %d of %d sinks: %s", len(failed), len(a.sinks.targets), strings.Join(reasons, "; "))
+
+	action := a.policy.action(failureSink)
+	d.step("apply %s failure policy: %s", failureSink, action)
+	if action == actionNACK {
+		return false, cehttp.NewResult(failureSink.status(), "%s: %w", failureSink, err)
+	}
+	a.deadLetter(ctx, event, failureSink, err)
+	return false, nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+// rejectEvents returns the URL of a sink responding with the specified status
+// code and the number of received requests
+func rejectEvents(t *testing.T, code int) (string, *int32) {
+	t.Helper()
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, &requests
+}
+
+// flakyEvents returns a sink rejecting the first requests with 503 and
+// recording the events of all requests
+func flakyEvents(t *testing.T, failures int) *eventReceiver {
+	t.Helper()
+
+	r := eventReceiver{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		event, err := binding.ToEvent(req.Context(), cehttp.NewMessageFromHttpRequest(req))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		r.Lock()
+		defer r.Unlock()
+		r.events = append(r.events, *event)
+		if len(r.events) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(srv.Close)
+
+	r.url = srv.URL
+	return &r
+}
+
+func Test_newSinks(t *testing.T) {
+	s, err := newSinks([]string{"", "http://sink-1", " http://sink-2", "http://sink-1"}, nil, retryPolicy{}, nil)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, s.targets, []string{"http://sink-1", "http://sink-2"})
+
+	s, err = newSinks([]string{""}, nil, retryPolicy{}, nil)
+	assert.NilError(t, err)
+	assert.Assert(t, s == nil)
+
+	_, err = newSinks([]string{"sink-1:8080"}, nil, retryPolicy{}, nil)
+	assert.ErrorContains(t, err, `invalid sink "sink-1:8080"`)
+}
+
+func Test_parseSinkTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    map[string]time.Duration
+		wantErr string
+	}{
+		{
+			name: "empty",
+			want: map[string]time.Duration{},
+		},
+		{
+			name:    "multiple sinks",
+			entries: []string{"http://sink-1=2s", " http://sink-2:8080/path?a=b = 30s", ""},
+			want: map[string]time.Duration{
+				"http://sink-1":               2 * time.Second,
+				"http://sink-2:8080/path?a=b": 30 * time.Second,
+			},
+		},
+		{
+			name:    "missing timeout",
+			entries: []string{"http://sink-1"},
+			wantErr: `invalid entry "http://sink-1"`,
+		},
+		{
+			name:    "invalid timeout",
+			entries: []string{"http://sink-1=soon"},
+			wantErr: `invalid timeout in "http://sink-1=soon"`,
+		},
+		{
+			name:    "negative timeout",
+			entries: []string{"http://sink-1=-1s"},
+			wantErr: `invalid timeout in "http://sink-1=-1s"`,
+		},
+		{
+			name:    "invalid sink",
+			entries: []string{"sink-1=1s"},
+			wantErr: `invalid sink "sink-1"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSinkTimeouts(tt.entries)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, got, tt.want)
+		})
+	}
+}
+
+func Test_sinks_send_timeouts(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(slow.Close)
+	patient := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(patient.Close)
+
+	m := newMetrics()
+	timeouts := map[string]time.Duration{slow.URL: 10 * time.Millisecond}
+	s, err := newSinks([]string{slow.URL, patient.URL}, timeouts, retryPolicy{attempts: 1, timeout: 5 * time.Second}, m)
+	assert.NilError(t, err)
+
+	testEvents := createCloudEvents(t)
+	failed := s.send(context.Background(), *testEvents["AlarmStatusChangedEvent"])
+	assert.Equal(t, len(failed), 1)
+	assert.Assert(t, errors.Is(failed[slow.URL], context.DeadlineExceeded), "error: %v", failed[slow.URL])
+	assert.Equal(t, m.deliveries.get(patient.URL, "success"), float64(1))
+}
+
+func Test_isSinkRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "bad request", err: cehttp.NewResult(http.StatusBadRequest, "invalid"), want: false},
+		{name: "throttled", err: cehttp.NewResult(http.StatusTooManyRequests, "slow down"), want: true},
+		{name: "server error", err: cehttp.NewResult(http.StatusServiceUnavailable, "unavailable"), want: true},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, want: true},
+		{name: "connection refused", err: errors.New("dial tcp: connection refused"), want: true},
+		{name: "cancelled", err: context.Canceled, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, isSinkRetryable(tt.err), tt.want)
+		})
+	}
+}
+
+func Test_alarmServer_handleEvent_sinks(t *testing.T) {
+	tests := []struct {
+		name           string
+		rejectCode     int // status code of the rejecting sink, 0 if both sinks accept
+		policy         failureAction
+		wantStatus     int // of the received event, 0 if acknowledged
+		wantRequests   int32
+		wantDeadLetter bool
+	}{
+		{
+			name: "acknowledged once all sinks accept",
+		},
+		{
+			name:         "retryable failure is rejected",
+			rejectCode:   http.StatusServiceUnavailable,
+			policy:       actionNACK,
+			wantStatus:   http.StatusBadGateway,
+			wantRequests: 3,
+		},
+		{
+			name:         "permanent failure is not retried",
+			rejectCode:   http.StatusBadRequest,
+			policy:       actionNACK,
+			wantStatus:   http.StatusBadGateway,
+			wantRequests: 1,
+		},
+		{
+			name:           "failure is dead-lettered with ack policy",
+			rejectCode:     http.StatusServiceUnavailable,
+			policy:         actionAck,
+			wantRequests:   3,
+			wantDeadLetter: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testEvents := createCloudEvents(t)
+			accepting := receiveEvents(t)
+			deadLetters := receiveEvents(t)
+
+			targets := []string{accepting.url}
+			var requests *int32
+			if tt.rejectCode != 0 {
+				var url string
+				url, requests = rejectEvents(t, tt.rejectCode)
+				targets = append(targets, url)
+			}
+
+			m := newMetrics()
+			s, err := newSinks(targets, nil, retryPolicy{attempts: 3, backoff: time.Millisecond, timeout: time.Second}, m)
+			assert.NilError(t, err)
+			dl, err := newDeadLetterSink(deadLetters.url, "")
+			assert.NilError(t, err)
+
+			c := newAlarmCache(3600)
+			c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+
+			a := &alarmServer{
+				session:     newSession(nil, ""),
+				cache:       c,
+				clock:       clock.NewMock(),
+				source:      vc,
+				suffix:      "." + suffix,
+				injectKey:   injectKey,
+				metrics:     m,
+				sinks:       s,
+				deadLetters: dl,
+				policy:      failurePolicy{sink: tt.policy},
+			}
+			ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+			got, result := a.handleEvent(ctx, *testEvents["AlarmStatusChangedEvent"])
+			assert.Assert(t, got == nil, "events are not returned as reply")
+
+			// sinks are independent
+			events := accepting.get()
+			assert.Equal(t, len(events), 1)
+			assert.Equal(t, events[0].Type(), "AlarmStatusChangedEvent."+suffix)
+			assert.Equal(t, m.deliveries.get(accepting.url, "success"), float64(1))
+
+			if requests != nil {
+				assert.Equal(t, atomic.LoadInt32(requests), tt.wantRequests)
+				assert.Equal(t, m.deliveries.get(targets[1], "failure"), float64(1))
+			}
+
+			if tt.wantStatus == 0 {
+				assert.Assert(t, result == nil, "result: %v", result)
+			} else {
+				var httpResult *cehttp.Result
+				assert.Assert(t, errors.As(result, &httpResult), "result: %v", result)
+				assert.Equal(t, httpResult.StatusCode, tt.wantStatus)
+			}
+
+			dead := deadLetters.get()
+			if !tt.wantDeadLetter {
+				assert.Equal(t, len(dead), 0)
+				return
+			}
+			assert.Equal(t, len(dead), 1)
+			assert.Equal(t, dead[0].Extensions()[errorClassExtension], string(failureSink))
+		})
+	}
+}
+
+func Test_alarmServer_deliver_sameID(t *testing.T) {
+	testEvents := createCloudEvents(t)
+	accepting := receiveEvents(t)
+	flaky := flakyEvents(t, 1)
+
+	m := newMetrics()
+	s, err := newSinks([]string{accepting.url, flaky.url}, nil, retryPolicy{attempts: 3, backoff: time.Millisecond, timeout: time.Second}, m)
+	assert.NilError(t, err)
+
+	c := newAlarmCache(3600)
+	c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+
+	a := &alarmServer{
+		session:   newSession(nil, ""),
+		cache:     c,
+		clock:     clock.NewMock(),
+		source:    vc,
+		suffix:    "." + suffix,
+		injectKey: injectKey,
+		metrics:   m,
+		sinks:     s,
+	}
+	ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+	_, result := a.handleEvent(ctx, *testEvents["AlarmStatusChangedEvent"])
+	assert.Assert(t, result == nil, "result: %v", result)
+
+	events := append(accepting.get(), flaky.get()...)
+	assert.Equal(t, len(events), 3, "one event to the accepting sink, two attempts to the flaky sink")
+	for _, e := range events[1:] {
+		assert.Equal(t, e.ID(), events[0].ID())
+		assert.Equal(t, e.Time(), events[0].Time())
+	}
+	assert.Assert(t, events[0].ID() != "")
+}
+
+func Test_alarmServer_deliver_nackSameID(t *testing.T) {
+	testEvents := createCloudEvents(t)
+	accepting := receiveEvents(t)
+	rejecting, _ := rejectEvents(t, http.StatusBadRequest)
+
+	m := newMetrics()
+	s, err := newSinks([]string{accepting.url, rejecting}, nil, retryPolicy{attempts: 1}, m)
+	assert.NilError(t, err)
+
+	c := newAlarmCache(3600)
+	c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+
+	a := &alarmServer{
+		session:   newSession(nil, ""),
+		cache:     c,
+		clock:     clock.NewMock(),
+		source:    vc,
+		suffix:    "." + suffix,
+		injectKey: injectKey,
+		metrics:   m,
+		sinks:     s,
+		policy:    failurePolicy{sink: actionNACK},
+	}
+	ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+	// the broker redelivers the rejected event
+	event := *testEvents["AlarmStatusChangedEvent"]
+	for i := 0; i < 2; i++ {
+		_, result := a.handleEvent(ctx, event)
+		assert.Assert(t, result != nil)
+	}
+
+	events := accepting.get()
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[0].ID(), responseID(event, events[0].Type()))
+	assert.Equal(t, events[1].ID(), events[0].ID(), "accepting sink can discard the redelivered response")
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/client"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	statusTimeout   = time.Second * 10
+	statusQueueSize = 16
+
+	// status event types
+	statusTypeHeartbeat       = "vsphere-alarm-server.heartbeat"
+	statusTypeStarted         = "vsphere-alarm-server.started"
+	statusTypeStopped         = "vsphere-alarm-server.stopped"
+	statusTypeConnected       = "vsphere-alarm-server.vcenter.connected"
+	statusTypeSessionLost     = "vsphere-alarm-server.vcenter.session.lost"
+	statusTypeSessionRestored = "vsphere-alarm-server.vcenter.session.restored"
+)
+
+// statusEmitter sends heartbeat and lifecycle events of the server to a
+// CloudEvents sink so that consumers can tell an idle server from a dead one.
+// A nil emitter does not send.
+type statusEmitter struct {
+	client  client.Client
+	target  string
+	source  string // identifies the server instance
+	subject string // vCenter URL
+
+	queue chan queuedStatus
+	lost  int32 // 1 after the session lost event was queued
+}
+
+type queuedStatus struct {
+	eventType string
+	data      statusData
+}
+
+// statusData is the payload of lifecycle events
+type statusData struct {
+	Error string `json:"error,omitempty"`
+}
+
+// heartbeatData is the payload of heartbeat events
+type heartbeatData struct {
+	UptimeSeconds int64          `json:"uptimeSeconds"`
+	Events        map[string]int `json:"events"` // by outcome since the last heartbeat
+	CacheSize     int            `json:"cacheSize"`
+	VCenter       vcenterStatus  `json:"vcenter"`
+}
+
+type vcenterStatus struct {
+	Connected     bool   `json:"connected"`
+	Authenticated bool   `json:"authenticated"`
+	Breaker       string `json:"breaker,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+func newStatusEmitter(target, vcURL string) (*statusEmitter, error) {
+	c, err := cloudevents.NewClientHTTP()
+	if err != nil {
+		return nil, fmt.Errorf("create status cloudevents client: %w", err)
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	return &statusEmitter{
+		client:  c,
+		target:  target,
+		source:  "/vsphere-alarm-server/" + host,
+		subject: vcURL,
+		queue:   make(chan queuedStatus, statusQueueSize),
+	}, nil
+}
+
+// send sends a status event with the specified type and data. Errors are
+// logged.
+func (s *statusEmitter) send(ctx context.Context, eventType string, data interface{}) {
+	if s == nil {
+		return
+	}
+
+	event := cloudevents.NewEvent()
+	event.SetSource(s.source)
+	event.SetType(eventType)
+	event.SetSubject(s.subject)
+
+	logger := logging.FromContext(ctx)
+	if err := event.SetData(cloudevents.ApplicationJSON, data); err != nil {
+		logger.Errorw("set status event data", "type", eventType, "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(cloudevents.ContextWithTarget(ctx, s.target), statusTimeout)
+	defer cancel()
+
+	if res := s.client.Send(ctx, event); !cloudevents.IsACK(res) {
+		logger.Warnw("could not send status event", "type", eventType, "target", s.target, "error", res)
+		return
+	}
+	logger.Debugw("sent status event", "type", eventType)
+}
+
+// lifecycle sends a lifecycle event with the optional error
+func (s *statusEmitter) lifecycle(ctx context.Context, eventType string, err error) {
+	if s == nil {
+		return
+	}
+	s.send(ctx, eventType, newStatusData(err))
+}
+
+// notify queues a lifecycle event with the optional error to be sent by the
+// status loop so that callers, e.g. holding the session lock, do not wait for
+// the sink. Events are dropped if the queue is full.
+func (s *statusEmitter) notify(ctx context.Context, eventType string, err error) {
+	if s == nil {
+		return
+	}
+
+	select {
+	case s.queue <- queuedStatus{eventType: eventType, data: newStatusData(err)}:
+	default:
+		logging.FromContext(ctx).Warnw("dropping status event: queue full", "type", eventType)
+	}
+}
+
+// sessionLost queues the session lost event once until the session is
+// restored
+func (s *statusEmitter) sessionLost(ctx context.Context, err error) {
+	if s == nil || !atomic.CompareAndSwapInt32(&s.lost, 0, 1) {
+		return
+	}
+	s.notify(ctx, statusTypeSessionLost, err)
+}
+
+// sessionRestored queues the session restored event if the session lost event
+// was sent
+func (s *statusEmitter) sessionRestored(ctx context.Context) {
+	if s == nil || !atomic.CompareAndSwapInt32(&s.lost, 1, 0) {
+		return
+	}
+	s.notify(ctx, statusTypeSessionRestored, nil)
+}
+
+func newStatusData(err error) statusData {
+	var data statusData
+	if err != nil {
+		data.Error = err.Error()
+	}
+	return data
+}
+
+// runStatus sends the started event, queued lifecycle events and heartbeats
+// until the context is cancelled. A zero heartbeat interval disables
+// heartbeats.
+func (a *alarmServer) runStatus(ctx context.Context) error {
+	if a.status == nil {
+		return nil
+	}
+
+	a.status.lifecycle(ctx, statusTypeStarted, nil)
+
+	var tick <-chan time.Time
+	if a.heartbeatInterval > 0 {
+		t := a.clock.Ticker(a.heartbeatInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	last := a.metrics.outcomes()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case q := <-a.status.queue:
+			a.status.send(ctx, q.eventType, q.data)
+		case <-tick:
+			var hb heartbeatData
+			hb, last = a.heartbeat(ctx, last)
+			a.status.send(ctx, statusTypeHeartbeat, hb)
+		}
+	}
+}
+
+// heartbeat returns the heartbeat data with the event counts since the
+// specified previous counts and the current counts
+func (a *alarmServer) heartbeat(ctx context.Context, previous map[string]float64) (heartbeatData, map[string]float64) {
+	current := a.metrics.outcomes()
+	events := make(map[string]int, len(current))
+	for outcome, n := range current {
+		events[outcome] = int(n - previous[outcome])
+	}
+
+	vcErr := a.probe.check(ctx, a.session)
+	status := vcenterStatus{
+		Connected:     a.session.connected(),
+		Authenticated: vcErr == nil,
+	}
+	if vcErr != nil {
+		status.Error = vcErr.Error()
+	}
+	if a.breaker != nil {
+		status.Breaker = string(a.breaker.status().State)
+	}
+
+	return heartbeatData{
+		UptimeSeconds: int64(a.now().Sub(a.started).Seconds()),
+		Events:        events,
+		CacheSize:     len(a.cache.keys()),
+		VCenter:       status,
+	}, current
+}
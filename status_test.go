@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func Test_alarmServer_heartbeat(t *testing.T) {
+	mock := clock.NewMock()
+	m := newMetrics()
+	c := newAlarmCache(3600)
+	c.add("Alarm:alarm-1", createAlarm(t, "alarm-1"))
+
+	a := &alarmServer{
+		session: newSession(nil, ""),
+		cache:   c,
+		metrics: m,
+		clock:   mock,
+		started: mock.Now(),
+	}
+	ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+	m.event(outcomeEnriched, "")
+	m.event(outcomeEnriched, "")
+	m.event(outcomeIgnored, reasonNotAlarm)
+	mock.Add(time.Minute)
+
+	hb, last := a.heartbeat(ctx, map[string]float64{})
+	assert.Equal(t, hb.UptimeSeconds, int64(60))
+	assert.DeepEqual(t, hb.Events, map[string]int{outcomeEnriched: 2, outcomeIgnored: 1})
+	assert.Equal(t, hb.CacheSize, 1)
+	assert.Equal(t, hb.VCenter.Connected, false)
+	assert.Equal(t, hb.VCenter.Authenticated, false)
+	assert.Equal(t, hb.VCenter.Error, errNotConnected.Error())
+
+	// only events since the last heartbeat are counted
+	m.event(outcomeEnriched, "")
+	mock.Add(time.Minute)
+
+	hb, _ = a.heartbeat(ctx, last)
+	assert.Equal(t, hb.UptimeSeconds, int64(120))
+	assert.DeepEqual(t, hb.Events, map[string]int{outcomeEnriched: 1, outcomeIgnored: 0})
+}
+
+func Test_statusEmitter_session(t *testing.T) {
+	s := &statusEmitter{queue: make(chan queuedStatus, statusQueueSize)}
+	ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+	// restored without lost is not sent
+	s.sessionRestored(ctx)
+	s.sessionLost(ctx, errNotAuthenticated)
+	s.sessionLost(ctx, errNotAuthenticated)
+	s.sessionRestored(ctx)
+	s.sessionRestored(ctx)
+	s.sessionLost(ctx, errNotAuthenticated)
+	close(s.queue)
+
+	var got []string
+	for q := range s.queue {
+		got = append(got, q.eventType)
+		if q.eventType == statusTypeSessionLost {
+			assert.Equal(t, q.data.Error, errNotAuthenticated.Error())
+		}
+	}
+	assert.DeepEqual(t, got, []string{statusTypeSessionLost, statusTypeSessionRestored, statusTypeSessionLost})
+}
+
+func Test_alarmServer_runStatus(t *testing.T) {
+	r := receiveEvents(t)
+	s, err := newStatusEmitter(r.url, "https://vcenter.local/sdk")
+	assert.NilError(t, err)
+
+	mock := clock.NewMock()
+	a := &alarmServer{
+		session:           newSession(nil, ""),
+		cache:             newAlarmCache(3600),
+		metrics:           newMetrics(),
+		clock:             mock,
+		started:           mock.Now(),
+		status:            s,
+		heartbeatInterval: time.Minute,
+	}
+
+	ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() {
+		done <- a.runStatus(ctx)
+	}()
+
+	s.notify(ctx, statusTypeConnected, nil)
+
+	// advance the mock clock until the ticker is created and fired
+	var events []cloudevents.Event
+	for i := 0; i < 50; i++ {
+		mock.Add(time.Minute)
+		time.Sleep(time.Millisecond * 20)
+		if events = r.get(); len(events) >= 3 {
+			break
+		}
+	}
+	cancel()
+	assert.NilError(t, <-done)
+
+	assert.Assert(t, len(events) >= 3)
+	assert.Equal(t, events[0].Type(), statusTypeStarted)
+	assert.Equal(t, events[0].Subject(), "https://vcenter.local/sdk")
+
+	types := map[string]bool{}
+	for _, e := range events {
+		types[e.Type()] = true
+		if e.Type() == statusTypeHeartbeat {
+			var hb heartbeatData
+			assert.NilError(t, json.Unmarshal(e.Data(), &hb))
+			assert.Equal(t, hb.VCenter.Connected, false)
+		}
+	}
+	assert.Assert(t, types[statusTypeConnected])
+	assert.Assert(t, types[statusTypeHeartbeat])
+}
+
+func Test_statusEmitter_nil(t *testing.T) {
+	var s *statusEmitter
+	ctx := logging.WithLogger(context.Background(), zaptest.NewLogger(t).Sugar())
+
+	s.send(ctx, statusTypeHeartbeat, heartbeatData{})
+	s.notify(ctx, statusTypeConnected, nil)
+	s.sessionLost(ctx, errNotAuthenticated)
+	s.sessionRestored(ctx)
+	assert.NilError(t, (&alarmServer{}).runStatus(ctx))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cetypes "github.com/cloudevents/sdk-go/v2/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// W3C trace context attributes of the CloudEvents distributed tracing
+// extension
+const (
+	traceParentExtension = "traceparent"
+	traceStateExtension  = "tracestate"
+)
+
+const (
+	tracerName = "github.com/embano1/vsphere-alarm-server"
+
+	// length of a version 00 traceparent: version-traceid-parentid-flags
+	traceParentSize = 2 + 1 + 32 + 1 + 16 + 1 + 2
+)
+
+// tracePropagator reads and writes the W3C trace context
+// (https://www.w3.org/TR/trace-context/) of events
+var tracePropagator = propagation.TraceContext{}
+
+// eventCarrier adapts the distributed tracing extension of an event to a
+// propagation.TextMapCarrier
+type eventCarrier struct {
+	event *cloudevents.Event
+}
+
+func (c eventCarrier) Get(key string) string {
+	v, ok := c.event.Extensions()[key]
+	if !ok {
+		return ""
+	}
+	s, err := cetypes.ToString(v)
+	if err != nil {
+		return ""
+	}
+	return s
+}
+
+func (c eventCarrier) Set(key, value string) {
+	c.event.SetExtension(key, value)
+}
+
+func (c eventCarrier) Keys() []string {
+	var keys []string
+	for _, k := range []string{traceParentExtension, traceStateExtension} {
+		if _, ok := c.event.Extensions()[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// extractTrace returns a context with the remote span context of the event if
+// the event carries a valid trace context
+func extractTrace(ctx context.Context, event cloudevents.Event) context.Context {
+	carrier := eventCarrier{event: &event}
+	// the propagator accepts additional fields in version 00, which the
+	// specification forbids
+	if p := carrier.Get(traceParentExtension); strings.HasPrefix(p, "00-") && len(p) != traceParentSize {
+		return ctx
+	}
+	return tracePropagator.Extract(ctx, carrier)
+}
+
+// propagateTrace sets the trace context of the span in ctx on the response so
+// that consumers of the response continue the trace. If tracing is disabled,
+// the span in ctx is the remote span of the received event, i.e. its trace
+// context is forwarded unchanged.
+func propagateTrace(ctx context.Context, resp *cloudevents.Event) {
+	tracePropagator.Inject(ctx, eventCarrier{event: resp})
+}
+
+// startSpan starts a span with the tracer of the server. Spans are not
+// recorded if tracing is disabled.
+func (a *alarmServer) startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	tracer := a.tracer
+	if tracer == nil {
+		tracer = trace.NewNoopTracerProvider().Tracer(tracerName)
+	}
+	return tracer.Start(ctx, name, opts...)
+}
+
+// endSpan records the error (if any) and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// newTracerProvider returns a tracer provider exporting spans in batches to the
+// OTLP/HTTP traces endpoint, e.g. http://otel-collector:4318/v1/traces
+func newTracerProvider(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parse OTLP_TRACES_ENDPOINT: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP_TRACES_ENDPOINT %q: must be an http or https URL", endpoint)
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Path != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("create OTLP trace exporter: %w", err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "vsphere-alarm-server"))),
+	), nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/benbjohnson/clock"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"go.opentelemetry.io/otel/trace"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/protobuf/proto"
+	"gotest.tools/assert"
+	"knative.dev/pkg/logging"
+)
+
+func Test_extractTrace(t *testing.T) {
+	tests := []struct {
+		name      string
+		parent    string
+		wantValid bool
+	}{
+		{
+			name:      "valid",
+			parent:    "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			wantValid: true,
+		},
+		{
+			name:      "future version with additional fields",
+			parent:    "cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra",
+			wantValid: true,
+		},
+		{
+			name:      "version 00 with additional fields",
+			parent:    "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			wantValid: false,
+		},
+		{
+			name:      "invalid version",
+			parent:    "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			wantValid: false,
+		},
+		{
+			name:      "zero trace id",
+			parent:    "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			wantValid: false,
+		},
+		{
+			name:      "zero parent id",
+			parent:    "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+			wantValid: false,
+		},
+		{
+			name:      "uppercase trace id",
+			parent:    "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+			wantValid: false,
+		},
+		{
+			name:      "too short",
+			parent:    "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+			wantValid: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := cloudevents.NewEvent()
+			event.SetExtension(traceParentExtension, tt.parent)
+
+			sc := trace.SpanContextFromContext(extractTrace(context.Background(), event))
+			assert.Equal(t, sc.IsValid(), tt.wantValid)
+			if !tt.wantValid {
+				return
+			}
+			assert.Equal(t, sc.TraceID().String(), "4bf92f3577b34da6a3ce929d0e0e4736")
+			assert.Equal(t, sc.SpanID().String(), "00f067aa0ba902b7")
+			assert.Assert(t, sc.IsRemote())
+		})
+	}
+}
+
+func Test_propagateTrace(t *testing.T) {
+	const (
+		parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+		state  = "congo=t61rcWkgMzE"
+	)
+
+	tests := []struct {
+		name       string
+		extensions map[string]string
+		wantTrace  bool
+	}{
+		{
+			name:       "no trace context",
+			extensions: nil,
+			wantTrace:  false,
+		},
+		{
+			name:       "invalid trace context",
+			extensions: map[string]string{traceParentExtension: "invalid"},
+			wantTrace:  false,
+		},
+		{
+			name:       "trace context with state",
+			extensions: map[string]string{traceParentExtension: parent, traceStateExtension: state},
+			wantTrace:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := cloudevents.NewEvent()
+			for k, v := range tt.extensions {
+				event.SetExtension(k, v)
+			}
+
+			// tracing disabled
+			a := &alarmServer{}
+			ctx, span := a.startSpan(extractTrace(context.Background(), event), "handle event")
+			defer span.End()
+
+			resp := cloudevents.NewEvent()
+			propagateTrace(ctx, &resp)
+
+			_, ok := resp.Extensions()[traceParentExtension]
+			assert.Equal(t, ok, tt.wantTrace)
+			if !tt.wantTrace {
+				return
+			}
+
+			// forwarded unchanged since spans are not recorded
+			assert.Equal(t, resp.Extensions()[traceParentExtension], parent)
+			assert.Equal(t, resp.Extensions()[traceStateExtension], state)
+		})
+	}
+}
+
+// otlpCollector is an in-process OTLP/HTTP collector recording the exported
+// spans
+type otlpCollector struct {
+	sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req collectortrace.ExportTraceServiceRequest
+	if err = proto.Unmarshal(b, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.Lock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	c.Unlock()
+
+	b, err = proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(b)
+}
+
+func Test_alarmServer_handleEvent_tracing(t *testing.T) {
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	simulator.Test(func(ctx context.Context, client *vim25.Client) {
+		collector := &otlpCollector{}
+		srv := httptest.NewServer(collector)
+		defer srv.Close()
+
+		tp, err := newTracerProvider(ctx, srv.URL+"/v1/traces")
+		assert.NilError(t, err)
+
+		a := &alarmServer{
+			session:        newSession(simulatorClient(t, client, "alarm-1"), ""),
+			cache:          newAlarmCache(3600),
+			clock:          clock.NewMock(),
+			source:         vc,
+			suffix:         "." + suffix,
+			injectKey:      injectKey,
+			metrics:        newMetrics(),
+			tracer:         tp.Tracer(tracerName),
+			tracerProvider: tp,
+		}
+		ctx = logging.WithLogger(ctx, zaptest.NewLogger(t).Sugar())
+
+		event := createCloudEvents(t)["AlarmStatusChangedEvent"].Clone()
+		event.SetExtension(traceParentExtension, parent)
+		resp, result := a.handleEvent(ctx, event)
+		assert.NilError(t, result)
+		assert.Assert(t, resp != nil)
+
+		// exports the batched spans
+		assert.NilError(t, tp.Shutdown(ctx))
+
+		collector.Lock()
+		defer collector.Unlock()
+		spans := map[string]*tracepb.Span{}
+		for _, s := range collector.spans {
+			assert.Equal(t, hex.EncodeToString(s.TraceId), "4bf92f3577b34da6a3ce929d0e0e4736")
+			spans[s.Name] = s
+		}
+		assert.Equal(t, len(spans), 5)
+
+		root := spans["handle event"]
+		assert.Assert(t, root != nil)
+		assert.Equal(t, hex.EncodeToString(root.ParentSpanId), "00f067aa0ba902b7")
+		for _, name := range []string{"decode event", "look up alarm in cache", "RetrieveOne", "patch event"} {
+			s, ok := spans[name]
+			assert.Assert(t, ok, "missing span %q", name)
+			assert.DeepEqual(t, s.ParentSpanId, root.SpanId)
+		}
+
+		// consumers of the response continue the trace after the server span
+		want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + hex.EncodeToString(root.SpanId) + "-01"
+		assert.Equal(t, resp.Extensions()[traceParentExtension], want)
+	})
+}